@@ -1,12 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"syscall"
 	"time"
 
 	obsws "github.com/christopher-dG/go-obs-websocket"
@@ -33,6 +37,7 @@ func main() {
 	redirectURL := viper.GetString("redirect_url")
 	channelName := viper.GetString("channel_name")
 	userAccessToken := viper.GetString("user_access_token")
+	refreshToken := viper.GetString("refresh_token")
 	obsPort := viper.GetInt("obs_port")
 	obsHostname := viper.GetString("obs_hostname")
 	obsPassword := viper.GetString("obs_password")
@@ -90,19 +95,102 @@ func main() {
 	fmt.Println("User ID: " + userID)
 	fmt.Println("Channel ID: " + channelID)
 
+	// Refresh the user access token when Twitch rejects it, saving the new tokens to our config file
+	var tokens pubsub.TokenSource = pubsub.StaticToken(userAccessToken)
+	if refreshToken != "" {
+		refreshTokens := pubsub.NewRefreshTokenSource(clientID, clientSecret, userAccessToken, refreshToken)
+		refreshTokens.OnRefresh = func(accessToken, refreshToken string) {
+			viper.Set("user_access_token", accessToken)
+			viper.Set("refresh_token", refreshToken)
+			if err := viper.WriteConfig(); err != nil {
+				log.Println(err)
+			}
+			log.Println("User access token has been refreshed")
+		}
+		tokens = refreshTokens
+	}
+
 	// Start listening to the PubSub API
-	pubSubClient := pubsub.NewPool(userAccessToken, http.Header{})
+	pubSubClient := pubsub.NewPoolWithOptions(userAccessToken, http.Header{}, pubsub.WithTokenSource(tokens))
 
 	// Create the topic to listen to
-	topic := fmt.Sprintf("channel-points-channel-v1.%s", channelID)
+	topic, err := pubsub.ChannelPointsTopic(channelID)
+	if err != nil {
+		panic(err)
+	}
+
+	// Route channel point redemptions to our handler, everything else is reported
+	pubSubClient.HandleType(pubsub.TypeRewardRedeemed, handleRewardRedeemed(c))
+	pubSubClient.HandleNotFound(func(data pubsub.MessageData) {
+		fmt.Printf("Unhandled message on topic \"%s\"\n", data.Topic)
+	})
+
+	// Listen to topic, routing through the handlers above
+	_, err = pubSubClient.Listen(topic, nil)
+	if err != nil {
+		panic(err)
+	}
+
+	// Function callback for when we start our PubSub client
+	pubSubClient.OnStart = func() {
+		fmt.Println("-- OnStart --------------------------------------")
+		fmt.Println("Starting Pub Sub!")
+	}
+
+	// Function callback for when we get an error on our PubSub client
+	pubSubClient.OnError = func(psc *pubsub.Conn, e error, i interface{}) {
+		fmt.Println("-- OnError --------------------------------------")
+		fmt.Println("Error has occurred")
+		fmt.Println(psc)
+		fmt.Println(i)
+		log.Println(e)
+	}
+
+	// Function callback for when our PubSub client connects to Twitch API
+	pubSubClient.OnConnect = func(conn *pubsub.Conn) {
+		fmt.Println("-- OnConnect ------------------------------------")
+		fmt.Println("Connected to Twitch API")
+	}
+
+	// Stop on SIGINT or SIGTERM, a second signal kills the process if shutting down hangs
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		defer signal.Stop(signals)
+		select {
+		case sig := <-signals:
+			signal.Stop(signals)
+			log.Println("Received", sig, "shutting down, send it again to force quit")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
-	// Listen to topic
-	_, err = pubSubClient.Listen(topic, func(data pubsub.MessageData) {
+	// Start and wait, redemptions in progress are finished before returning
+	err = pubSubClient.Run(ctx)
+	if err != nil && !errors.Is(err, context.Canceled) {
+		log.Println(err)
+	}
+
+}
+
+// handleRewardRedeemed acts on the rewards we know about
+func handleRewardRedeemed(c obsws.Client) pubsub.TopicCallback {
+	return func(data pubsub.MessageData) {
 		fmt.Println("-- PubSub Update ---------------------------------")
 
-		// A reward has been redeemed cast to object
-		var rewardRedeemed pubsub.RewardRedeemed
-		json.Unmarshal([]byte(data.Message), &rewardRedeemed)
+		// Decode the channel points message and only act on redemptions
+		event, err := pubsub.DecodeChannelPoints(data)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		rewardRedeemed, ok := event.(*pubsub.RewardRedeemed)
+		if !ok {
+			return
+		}
 
 		// Grab the source name from our config file
 		musicSource := viper.GetString("music_source")
@@ -113,24 +201,28 @@ func main() {
 			// Send and receive a request asynchronously.
 			req := obsws.NewSetMuteRequest(musicSource, true)
 			if err := req.Send(c); err != nil {
-				log.Fatal(err)
+				log.Println(err)
+				return
 			}
 			// This will block until the response comes (potentially forever).
 			resp, err := req.Receive()
 			if err != nil {
-				log.Fatal(err)
+				log.Println(err)
+				return
 			}
 			log.Println("Music has been set to: ", resp.Status())
 		case pubsub.StatusUnMuteMusic:
 			// Send and receive a request asynchronously.
 			req := obsws.NewSetMuteRequest(musicSource, false)
 			if err := req.Send(c); err != nil {
-				log.Fatal(err)
+				log.Println(err)
+				return
 			}
 			// This will block until the response comes (potentially forever).
 			resp, err := req.Receive()
 			if err != nil {
-				log.Fatal(err)
+				log.Println(err)
+				return
 			}
 			log.Println("Music has been set to: ", resp.Status())
 		case pubsub.StatusSkipSong:
@@ -143,47 +235,13 @@ func main() {
 			// Execute the command
 			_, err = cmd.Output()
 			if err != nil {
-				log.Fatal(err)
+				log.Println(err)
+				return
 			}
 			log.Println("Song has been skipped")
 		default:
 			// Invalid title was passed
 			fmt.Printf("Invalid redemption title \"%s\" was entered\n", title)
 		}
-	})
-	if err != nil {
-		panic(err)
 	}
-
-	// Function callback for when we start our PubSub client
-	pubSubClient.OnStart = func() {
-		fmt.Println("-- OnStart --------------------------------------")
-		fmt.Println("Starting Pub Sub!")
-	}
-
-	// Function callback for when we get an error on our PubSub client
-	pubSubClient.OnError = func(psc *pubsub.Conn, e error, i interface{}) {
-		fmt.Println("-- OnError --------------------------------------")
-		fmt.Println("Error has occurred")
-		fmt.Println(psc)
-		fmt.Println(i)
-		panic(e)
-	}
-
-	// Function callback for when our PubSub client connects to Twitch API
-	pubSubClient.OnConnect = func(conn *pubsub.Conn) {
-		fmt.Println("-- OnConnect ------------------------------------")
-		fmt.Println("Connected to Twitch API")
-	}
-
-	// Start and wait
-	err = pubSubClient.Start()
-	if err != nil {
-		panic(err)
-	}
-
-	// Block the main thread so we keep listening to topics
-	wait := make(chan bool)
-	<-wait
-
 }
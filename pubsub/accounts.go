@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrTokenSourceNotComparable is when a TokenSource cannot identify an account, e.g. a func or a map
+var ErrTokenSourceNotComparable = errors.New("token source is not comparable")
+
+// comparableTokens reports whether the TokenSource can be used to key the accounts
+func comparableTokens(tokens TokenSource) bool {
+	return tokens == nil || reflect.TypeOf(tokens).Comparable()
+}
+
+// ListenWithToken listens to a topic with its own access token, for running the Pool
+// on behalf of several accounts
+func (p *Pool) ListenWithToken(topic, token string, callback TopicCallback) (*Topic, error) {
+	return p.ListenWithTokenSource(topic, StaticToken(token), callback)
+}
+
+// ListenWithTokenSource listens to a topic with its own TokenSource. A refresh or revocation
+// of that token only affects the topics listened to with it. The TokenSource is used as a
+// map key, so it must be comparable, e.g. a StaticToken or a pointer, otherwise
+// ErrTokenSourceNotComparable is returned. A nil TokenSource uses the token the Pool was
+// created with.
+func (p *Pool) ListenWithTokenSource(topic string, tokens TokenSource, callback TopicCallback) (*Topic, error) {
+	if p.isClosed() {
+		return nil, fmt.Errorf("listen topic %s: %w", topic, ErrClosed)
+	}
+	if !comparableTokens(tokens) {
+		return nil, fmt.Errorf("listen topic %s: %T: %w", topic, tokens, ErrTokenSourceNotComparable)
+	}
+	callback = p.route(callback)
+
+	return p.listenReserved(topic, func(conn *Conn) (*Topic, error) {
+		return conn.ListenWithTokenSource(topic, tokens, callback)
+	})
+}
+
+// AccountTopics returns the topics listened to with the TokenSource
+func (p *Pool) AccountTopics(tokens TokenSource) []string {
+	if !comparableTokens(tokens) {
+		return nil
+	}
+
+	p.accountsMutex.Lock()
+	defer p.accountsMutex.Unlock()
+
+	topics := make([]string, 0, len(p.accounts[tokens]))
+	for topic := range p.accounts[tokens] {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// UnlistenAccount unlistens every topic listened to with the TokenSource, e.g. after it was revoked
+func (p *Pool) UnlistenAccount(tokens TokenSource) error {
+	return p.UnlistenMany(p.AccountTopics(tokens)...)
+}
+
+// trackTopic remembers the account of a topic. Topics using a TokenSource that is not
+// comparable, which can only be the one passed to WithTokenSource, are not tracked
+func (p *Pool) trackTopic(t *Topic) {
+	if !comparableTokens(t.tokens) {
+		return
+	}
+
+	p.accountsMutex.Lock()
+	defer p.accountsMutex.Unlock()
+
+	topics, ok := p.accounts[t.tokens]
+	if !ok {
+		topics = make(map[string]struct{})
+		p.accounts[t.tokens] = topics
+	}
+	topics[t.Name] = struct{}{}
+}
+
+// untrackTopic forgets a topic a connection removed. Holding the registry mutex keeps
+// it in step with settle
+func (p *Pool) untrackTopic(t *Topic) {
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+	p.registry.removeLocked(t)
+	if !comparableTokens(t.tokens) {
+		return
+	}
+
+	p.accountsMutex.Lock()
+	defer p.accountsMutex.Unlock()
+
+	topics, ok := p.accounts[t.tokens]
+	if !ok {
+		return
+	}
+	delete(topics, t.Name)
+	if len(topics) == 0 {
+		delete(p.accounts, t.tokens)
+	}
+}
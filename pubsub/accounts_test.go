@@ -0,0 +1,55 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// funcTokens is a TokenSource that cannot be used as a map key
+type funcTokens func() (string, error)
+
+func (f funcTokens) Token() (string, error) { return f() }
+
+func (f funcTokens) Refresh(rejected string) (string, error) { return f() }
+
+func TestPoolAccountsWithUncomparableTokenSource(t *testing.T) {
+	tokens := funcTokens(func() (string, error) { return "token", nil })
+
+	pool := NewPoolWithOptions("", nil, WithURL("ws://127.0.0.1:0"), WithTokenSource(tokens))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	_, err := pool.ListenWithTokenSource("topic.1", tokens, nil)
+	if !errors.Is(err, ErrTokenSourceNotComparable) {
+		t.Errorf("listen = %v, want %v", err, ErrTokenSourceNotComparable)
+	}
+	if topics := pool.AccountTopics(tokens); len(topics) != 0 {
+		t.Errorf("account topics = %v, want none", topics)
+	}
+
+	// the pool's own TokenSource still works, its topics are just not tracked by account
+	if _, err := pool.Listen("topic.2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if !pool.IsListening("topic.2") {
+		t.Error("pool not listening to topic.2")
+	}
+	if err := pool.Unlisten("topic.2"); err != nil {
+		t.Fatal(err)
+	}
+
+	account := StaticToken("account")
+	if _, err := pool.ListenWithTokenSource("topic.3", account, nil); err != nil {
+		t.Fatal(err)
+	}
+	if topics := pool.AccountTopics(account); len(topics) != 1 || topics[0] != "topic.3" {
+		t.Errorf("account topics = %v, want [topic.3]", topics)
+	}
+}
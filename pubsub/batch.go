@@ -0,0 +1,200 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Defaults for sending LISTENs for many topics at once
+const (
+	defaultListenBatchSize = 10
+	defaultRelistenJitter  = time.Second * 2
+)
+
+// listenBatch is a LISTEN sent for several topics sharing an auth token
+type listenBatch struct {
+	ws     *BasicWebsocket
+	topics []*Topic
+}
+
+// send writes a LISTEN or UNLISTEN to the socket, waiting for the rate limit first
+func (c *Conn) send(ctx context.Context, ws *BasicWebsocket, message RequestMessage) error {
+	err := c.limiter.wait(ctx, c.closed)
+	if err != nil {
+		return err
+	}
+	return ws.SendJSONContext(ctx, message)
+}
+
+// listenBatched listens to the topics on the socket, grouping topics with the same auth token
+// into LISTENs of up to WithListenBatchSize topics. Returns the first topic of a LISTEN that failed to send
+func (c *Conn) listenBatched(ctx context.Context, ws *BasicWebsocket, topics []*Topic) (*Topic, error) {
+	var messages []RequestMessage
+	var firstTopics []*Topic
+
+	c.topicsMutex.RLock()
+	var tokens []string
+	byToken := make(map[string][]*Topic)
+	for _, topic := range topics {
+		if _, ok := byToken[topic.AuthToken]; !ok {
+			tokens = append(tokens, topic.AuthToken)
+		}
+		byToken[topic.AuthToken] = append(byToken[topic.AuthToken], topic)
+	}
+
+	for _, token := range tokens {
+		group := byToken[token]
+		for len(group) > 0 {
+			n := len(group)
+			if n > c.options.listenBatchSize {
+				n = c.options.listenBatchSize
+			}
+			chunk := group[:n]
+			group = group[n:]
+
+			// a single topic keeps its own nonce and needs no bookkeeping
+			if len(chunk) == 1 {
+				messages = append(messages, chunk[0].ListenMessage())
+				firstTopics = append(firstTopics, chunk[0])
+				continue
+			}
+
+			nonce, err := GenerateRandomNonce(nonceLength)
+			if err != nil {
+				c.topicsMutex.RUnlock()
+				return chunk[0], err
+			}
+			names := make([]string, 0, len(chunk))
+			for _, topic := range chunk {
+				names = append(names, topic.Name)
+			}
+
+			c.batchesMutex.Lock()
+			c.batches[nonce] = &listenBatch{ws: ws, topics: chunk}
+			c.batchesMutex.Unlock()
+
+			messages = append(messages, RequestMessage{
+				BaseMessage: BaseMessage{
+					Type: "LISTEN",
+				},
+				Nonce: nonce,
+				Data: ListenData{
+					Topics:    names,
+					AuthToken: token,
+				},
+			})
+			firstTopics = append(firstTopics, chunk[0])
+		}
+	}
+	c.topicsMutex.RUnlock()
+
+	for i, message := range messages {
+		err := c.send(ctx, ws, message)
+		if err != nil {
+			return firstTopics[i], err
+		}
+	}
+	return nil, nil
+}
+
+// takeBatch removes and returns the batch sent with the nonce
+func (c *Conn) takeBatch(nonce string) *listenBatch {
+	c.batchesMutex.Lock()
+	defer c.batchesMutex.Unlock()
+
+	batch, ok := c.batches[nonce]
+	if !ok {
+		return nil
+	}
+	delete(c.batches, nonce)
+	return batch
+}
+
+// dropBatches forgets the batches sent on a socket that will not answer them anymore
+func (c *Conn) dropBatches(ws *BasicWebsocket) {
+	c.batchesMutex.Lock()
+	defer c.batchesMutex.Unlock()
+
+	for nonce, batch := range c.batches {
+		if batch.ws == ws {
+			delete(c.batches, nonce)
+		}
+	}
+}
+
+// onBatchResponse settles every topic of a batched LISTEN. On ERR_BADAUTH the token is refreshed
+// once for all of them and they are listened to together again. Other errors may only concern
+// some of the topics, so they are listened to one by one to find those
+func (c *Conn) onBatchResponse(batch *listenBatch, err error) {
+	if err == nil {
+		var nonces []string
+		c.topicsMutex.Lock()
+		for _, topic := range batch.topics {
+			topic.authRetries = 0
+			nonces = append(nonces, topic.Nonce)
+		}
+		c.topicsMutex.Unlock()
+
+		for _, nonce := range nonces {
+			c.pending.resolve(nonce, nil)
+		}
+		return
+	}
+
+	if errors.Is(err, ErrBadAuth) {
+		for _, topic := range batch.topics {
+			// unlistened in the meantime
+			if c.getTopicByName(topic.Name) != topic {
+				continue
+			}
+			if !c.startAuthRetry(topic) {
+				c.rejectTopic(topic, err)
+			}
+		}
+		return
+	}
+
+	c.goAsync(func() {
+		for _, topic := range batch.topics {
+			// unlistened in the meantime
+			if c.getTopicByName(topic.Name) != topic {
+				continue
+			}
+
+			c.topicsMutex.RLock()
+			message := topic.ListenMessage()
+			c.topicsMutex.RUnlock()
+
+			sendErr := c.send(context.Background(), batch.ws, message)
+			if sendErr != nil {
+				c.OnError(sendErr, topic)
+				return
+			}
+		}
+	})
+}
+
+// relistenAfterJitter listens to the topics on the socket after a random delay of up to jitter,
+// so connections that reconnect at the same time do not all send their LISTENs at once
+func (c *Conn) relistenAfterJitter(ws *BasicWebsocket, topics []*Topic, jitter time.Duration) {
+	if jitter > 0 {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(jitter))))
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			return
+		}
+	}
+
+	if !ws.IsConnected() || ws != c.socket() {
+		return
+	}
+
+	t, err := c.listenToTopics(ws, topics)
+	if err != nil {
+		c.OnError(err, t)
+	}
+}
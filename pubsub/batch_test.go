@@ -0,0 +1,196 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartListensInBatchesWithoutJitter(t *testing.T) {
+	const topics = 23
+	const batchSize = 5
+
+	fs := newFakeServer(t)
+	var mutex sync.Mutex
+	var sizes []int
+	fs.onRequest = func(fc *fakeClient, request testRequest) {
+		if request.Type == "LISTEN" {
+			mutex.Lock()
+			sizes = append(sizes, len(request.Data.Topics))
+			mutex.Unlock()
+		}
+	}
+
+	// a jitter far longer than the test, the first connect must not wait for it
+	conn := NewConnWithOptions("token", nil, WithURL(fs.url()),
+		WithListenBatchSize(batchSize), WithRelistenJitter(time.Hour))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	for i := 0; i < topics; i++ {
+		if _, err := conn.Listen(fmt.Sprintf("topic.%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, time.Second, func() bool {
+		for i := 0; i < topics; i++ {
+			if fc := fs.client(0); fc == nil || !fc.listening(fmt.Sprintf("topic.%d", i)) {
+				return false
+			}
+		}
+		return true
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	total := 0
+	for _, size := range sizes {
+		if size > batchSize {
+			t.Errorf("LISTEN with %d topics, at most %d allowed", size, batchSize)
+		}
+		total += size
+	}
+	if total != topics {
+		t.Errorf("LISTEN sent for %d topics, want %d", total, topics)
+	}
+}
+
+func TestPoolListenManyColdStartRejected(t *testing.T) {
+	const topics = 20
+
+	fs := newFakeServer(t)
+	fs.reject = func(request testRequest) string {
+		for _, topic := range request.Data.Topics {
+			if strings.HasPrefix(topic, "bad.") {
+				return "ERR_BADTOPIC"
+			}
+		}
+		return ""
+	}
+
+	pool := NewPoolWithOptions("token", nil, WithURL(fs.url()))
+	var mutex sync.Mutex
+	rejected := make(map[string]int)
+	pool.OnError = func(conn *Conn, err error, info interface{}) {
+		topic, ok := info.(*Topic)
+		if !errors.Is(err, ErrBadTopic) || !ok {
+			t.Errorf("pool error: %v", err)
+			return
+		}
+		mutex.Lock()
+		rejected[topic.Name]++
+		mutex.Unlock()
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	// no connection yet, ListenMany opens the first one
+	var names []string
+	for i := 0; i < topics; i++ {
+		names = append(names, fmt.Sprintf("bad.%d", i), fmt.Sprintf("good.%d", i))
+	}
+	if _, err := pool.ListenMany(nil, names...); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(rejected) == topics
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := 0; i < topics; i++ {
+		bad, good := fmt.Sprintf("bad.%d", i), fmt.Sprintf("good.%d", i)
+		if n := rejected[bad]; n != 1 {
+			t.Errorf("%s reported %d times, want once", bad, n)
+		}
+		if pool.IsListening(bad) {
+			t.Errorf("pool still listening to rejected %s", bad)
+		}
+		if !pool.IsListening(good) || !fs.client(0).listening(good) {
+			t.Errorf("pool not listening to %s", good)
+		}
+	}
+}
+
+func TestBatchRefreshesTokenOnce(t *testing.T) {
+	const topics = 20
+
+	fs := newFakeServer(t)
+	var mutex sync.Mutex
+	var listens []int
+	fs.reject = func(request testRequest) string {
+		if request.Data.AuthToken == "old" {
+			return "ERR_BADAUTH"
+		}
+		mutex.Lock()
+		listens = append(listens, len(request.Data.Topics))
+		mutex.Unlock()
+		return ""
+	}
+
+	tokens := &countingTokens{token: "old"}
+	conn := NewConnWithOptions("", nil, WithURL(fs.url()), WithTokenSource(tokens))
+	conn.OnError = func(err error, info interface{}) {
+		t.Errorf("conn error: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	for i := 0; i < topics; i++ {
+		if _, err := conn.Listen(fmt.Sprintf("topic.%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		for i := 0; i < topics; i++ {
+			if fc := fs.client(0); fc == nil || !fc.listening(fmt.Sprintf("topic.%d", i)) {
+				return false
+			}
+		}
+		return true
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	if n := tokens.count(); n != 1 {
+		t.Errorf("refreshes = %d, want 1", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if want := (topics + defaultListenBatchSize - 1) / defaultListenBatchSize; len(listens) != want {
+		t.Errorf("%d LISTENs with the new token %v, want %d", len(listens), listens, want)
+	}
+}
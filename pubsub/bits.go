@@ -0,0 +1,84 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Bits message types. Badge unlocks do not carry a type, so theirs is our own
+const (
+	TypeBitsEvent        = "bits_event"
+	TypeBitsBadgeUnlock  = "bits_badge_unlock"
+	anonymousCheererName = "ananonymouscheerer"
+)
+
+// BadgeEntitlement is the bits badge a cheer unlocked
+type BadgeEntitlement struct {
+	NewVersion      int `json:"new_version"`
+	PreviousVersion int `json:"previous_version"`
+}
+
+// BitsEvent is a cheer from channel-bits-events-v1 or channel-bits-events-v2
+type BitsEvent struct {
+	Data struct {
+		UserName      string    `json:"user_name"`
+		ChannelName   string    `json:"channel_name"`
+		UserID        string    `json:"user_id"`
+		ChannelID     string    `json:"channel_id"`
+		Time          time.Time `json:"time"`
+		ChatMessage   string    `json:"chat_message"`
+		BitsUsed      int       `json:"bits_used"`
+		TotalBitsUsed int       `json:"total_bits_used"`
+		IsAnonymous   bool      `json:"is_anonymous"`
+		Context       string    `json:"context"`
+		// Only set when the cheer unlocked a new bits badge
+		BadgeEntitlement *BadgeEntitlement `json:"badge_entitlement"`
+	} `json:"data"`
+	Version         string `json:"version"`
+	BitsMessageType string `json:"message_type"`
+	MessageID       string `json:"message_id"`
+}
+
+// MessageType implements Event
+func (e *BitsEvent) MessageType() string { return e.BitsMessageType }
+
+// Anonymous reports whether the cheer was anonymous. Version 1 messages only
+// tell us through the placeholder user name
+func (e *BitsEvent) Anonymous() bool {
+	return e.Data.IsAnonymous || e.Data.UserName == anonymousCheererName
+}
+
+// BitsBadgeUnlock is from channel-bits-badge-unlocks, when a user shares a new bits badge in chat
+type BitsBadgeUnlock struct {
+	UserID      string    `json:"user_id"`
+	UserName    string    `json:"user_name"`
+	ChannelID   string    `json:"channel_id"`
+	ChannelName string    `json:"channel_name"`
+	BadgeTier   int       `json:"badge_tier"`
+	ChatMessage string    `json:"chat_message"`
+	Time        time.Time `json:"time"`
+}
+
+// MessageType implements Event
+func (e *BitsBadgeUnlock) MessageType() string { return TypeBitsBadgeUnlock }
+
+// DecodeBits decodes a channel-bits-events-v1 or channel-bits-events-v2 message
+func DecodeBits(data MessageData) (*BitsEvent, error) {
+	event := &BitsEvent{}
+	err := json.Unmarshal([]byte(data.Message), event)
+	if err != nil {
+		return nil, fmt.Errorf("decode bits message on %s: %w", data.Topic, err)
+	}
+	return event, nil
+}
+
+// DecodeBitsBadgeUnlock decodes a channel-bits-badge-unlocks message
+func DecodeBitsBadgeUnlock(data MessageData) (*BitsBadgeUnlock, error) {
+	event := &BitsBadgeUnlock{}
+	err := json.Unmarshal([]byte(data.Message), event)
+	if err != nil {
+		return nil, fmt.Errorf("decode bits badge message on %s: %w", data.Topic, err)
+	}
+	return event, nil
+}
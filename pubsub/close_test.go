@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// waitForGoroutines fails the test when the goroutine count stays above n
+func waitForGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines, want at most %d\n%s", runtime.NumGoroutine(), n, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPoolCloseLeaksNoGoroutines(t *testing.T) {
+	fs := newFakeServer(t)
+	baseline := runtime.NumGoroutine()
+
+	pool := NewPoolWithOptions("token", nil, WithURL(fs.url()))
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan struct{}, 1)
+	for i := 0; i < maxTopics+10; i++ {
+		if _, err := pool.Listen(fmt.Sprintf("topic.%d", i), func(MessageData) {
+			received <- struct{}{}
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.client(0).sendMessage("topic.0", "message")
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := pool.Close(ctx); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	for i := 0; i < maxTopics+10; i++ {
+		if name := fmt.Sprintf("topic.%d", i); pool.IsListening(name) {
+			t.Errorf("pool still listening to %s after close", name)
+		}
+	}
+	waitForGoroutines(t, baseline)
+}
+
+func TestConnCloseTimeoutLeaksNoGoroutines(t *testing.T) {
+	const topic = "topic.0"
+
+	fs := newFakeServer(t)
+	baseline := runtime.NumGoroutine()
+
+	conn := NewConnWithOptions("token", nil, WithURL(fs.url()))
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	if _, err := conn.ListenContext(context.Background(), topic, func(MessageData) {
+		close(entered)
+		<-release
+	}); err != nil {
+		t.Fatal(err)
+	}
+	fs.client(0).sendMessage(topic, "message")
+	<-entered
+
+	// the callback outlives the ctx, Close gives up waiting for it
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.Close(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("close = %v, want deadline exceeded", err)
+	}
+	if conn.IsListening(topic) {
+		t.Errorf("conn still listening to %s after close", topic)
+	}
+
+	close(release)
+	waitForGoroutines(t, baseline)
+}
@@ -0,0 +1,402 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Limits for moving topics between connections of a Pool
+const (
+	moveTimeout = time.Second * 10
+	// How long a retired connection may take to flush and finish its callbacks
+	retireTimeout = time.Second * 10
+)
+
+// errNotConnected is when a topic cannot move to a connection that is not connected
+var errNotConnected = errors.New("not connected")
+
+// adoptTopic listens to a topic moving over from another connection and waits for Twitch to
+// acknowledge it. The LISTEN uses its own nonce, so a rejection only fails the move.
+// Delivery is started by the caller once the other connection released the topic
+func (c *Conn) adoptTopic(ctx context.Context, topic *Topic) error {
+	nonce, err := GenerateRandomNonce(nonceLength)
+	if err != nil {
+		return err
+	}
+
+	ws := c.socket()
+	if !ws.IsConnected() {
+		return errNotConnected
+	}
+
+	c.topicsMutex.Lock()
+	if len(c.topics) >= maxTopics {
+		c.topicsMutex.Unlock()
+		return ErrTooManyTopics
+	}
+	if _, ok := c.topics[topic.Name]; ok {
+		c.topicsMutex.Unlock()
+		return fmt.Errorf("listen topic %q: %w", topic.Name, ErrDuplicateTopic)
+	}
+	if c.isClosing() {
+		c.topicsMutex.Unlock()
+		return ErrClosed
+	}
+	c.indexTopicLocked(topic)
+	delete(c.released, topic.Name)
+
+	message := topic.ListenMessage()
+	message.Nonce = nonce
+	c.topicsMutex.Unlock()
+
+	response := c.pending.add(nonce)
+	defer c.pending.remove(response)
+
+	err = c.send(ctx, ws, message)
+	if err == nil {
+		select {
+		case err = <-response:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil {
+		c.dropTopic(topic)
+		return err
+	}
+	return nil
+}
+
+// releaseTopic unlistens a topic that moved to another connection and waits for Twitch to
+// acknowledge that, delivering what arrives in the meantime. The topic is then removed without
+// ending its delivery, and messages still arriving for it are ignored.
+// Returns false if the topic was no longer registered
+func (c *Conn) releaseTopic(ctx context.Context, topic *Topic) (bool, error) {
+	if c.getTopicByName(topic.Name) != topic {
+		return false, nil
+	}
+
+	nonce, err := GenerateRandomNonce(nonceLength)
+	if err != nil {
+		return false, err
+	}
+
+	if ws := c.socket(); ws.IsConnected() {
+		matchTopic := &Topic{
+			Name:  topic.Name,
+			Nonce: nonce,
+		}
+		response := c.pending.add(nonce)
+		defer c.pending.remove(response)
+
+		err = c.send(ctx, ws, matchTopic.UnlistenMessage())
+		if err == nil {
+			select {
+			case err = <-response:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			err = fmt.Errorf("unlisten topic %q: %w", topic.Name, err)
+		}
+	}
+
+	if !c.dropTopic(topic) {
+		return false, err
+	}
+
+	c.topicsMutex.Lock()
+	now := time.Now()
+	for name, until := range c.released {
+		if now.After(until) {
+			delete(c.released, name)
+		}
+	}
+	c.released[topic.Name] = now.Add(moveTimeout + overlapGrace)
+	c.topicsMutex.Unlock()
+
+	c.delivery.detach(topic)
+	return true, err
+}
+
+// dropTopic takes the topic out of the list, leaving its delivery alone
+func (c *Conn) dropTopic(topic *Topic) bool {
+	c.topicsMutex.Lock()
+	defer c.topicsMutex.Unlock()
+
+	if c.topics[topic.Name] != topic {
+		return false
+	}
+	c.unindexTopicLocked(topic)
+	return true
+}
+
+// isReleased reports whether the topic recently moved to another connection
+func (c *Conn) isReleased(name string) bool {
+	c.topicsMutex.RLock()
+	defer c.topicsMutex.RUnlock()
+
+	until, ok := c.released[name]
+	return ok && time.Now().Before(until)
+}
+
+// topicsSnapshot returns a copy of the registered topics
+func (c *Conn) topicsSnapshot() []*Topic {
+	c.topicsMutex.RLock()
+	defer c.topicsMutex.RUnlock()
+	topics := make([]*Topic, 0, len(c.topics))
+	for _, topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Compact moves the topics of sparsely used connections onto the others and closes the
+// connections left empty. Each topic is listened to on its new connection before it is
+// unlistened on the old one, so no message is missed. When CompactInterval is set it runs
+// that often while the pool is started.
+func (p *Pool) Compact(ctx context.Context) error {
+	p.compactMutex.Lock()
+	defer p.compactMutex.Unlock()
+
+	for {
+		if p.isClosed() {
+			return ErrClosed
+		}
+
+		source, targets := p.compactionSource()
+		if source == nil {
+			return nil
+		}
+
+		for _, topic := range source.topicsSnapshot() {
+			target := p.fullestWithRoom(targets)
+			if target == nil {
+				break
+			}
+
+			err := p.moveTopic(ctx, topic, source, target)
+			if err != nil {
+				p.undrain(source)
+				return err
+			}
+		}
+
+		retired, err := p.retireConnection(ctx, source)
+		if err != nil {
+			return err
+		}
+		if !retired {
+			// topics were added in the meantime, try again next time
+			return nil
+		}
+	}
+}
+
+// compactionSource picks the connection with the fewest topics if the other connections have
+// room for all of them, and marks it as draining so no new topics are put on it.
+// Returns the connections its topics can move to as well
+func (p *Pool) compactionSource() (*Conn, []*Conn) {
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+	p.connectionsMutex.Lock()
+	defer p.connectionsMutex.Unlock()
+
+	if len(p.connections) < 2 {
+		return nil, nil
+	}
+
+	var source *Conn
+	for _, conn := range p.connections {
+		if source == nil || p.registry.slots[conn] < p.registry.slots[source] {
+			source = conn
+		}
+	}
+
+	var targets []*Conn
+	capacity := 0
+	for _, conn := range p.connections {
+		if conn == source || conn.State() != StateConnected {
+			continue
+		}
+		targets = append(targets, conn)
+		capacity += p.registry.freeLocked(conn)
+	}
+
+	count := p.registry.slots[source]
+	if count > 0 && count > capacity {
+		return nil, nil
+	}
+	p.draining[source] = struct{}{}
+	return source, targets
+}
+
+// fullestWithRoom picks the connection to move a topic to, filling up busy connections first
+func (p *Pool) fullestWithRoom(conns []*Conn) *Conn {
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+
+	var target *Conn
+	targetFree := 0
+	for _, conn := range conns {
+		free := p.registry.freeLocked(conn)
+		if free > 0 && (target == nil || free < targetFree) {
+			target = conn
+			targetFree = free
+		}
+	}
+	return target
+}
+
+func (p *Pool) undrain(conn *Conn) {
+	p.connectionsMutex.Lock()
+	delete(p.draining, conn)
+	p.connectionsMutex.Unlock()
+}
+
+// moveTopic listens to the topic on the target, then unlistens it on the source and hands its
+// delivery over. Messages both connections deliver in the meantime are only handled once
+func (p *Pool) moveTopic(ctx context.Context, topic *Topic, source, target *Conn) error {
+	// unlistened in the meantime, or the target filled up
+	if source.getTopicByName(topic.Name) != topic || !p.registry.startMove(topic, target) {
+		return nil
+	}
+	moved := false
+	defer func() {
+		p.registry.endMove(topic, moved)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, moveTimeout)
+	defer cancel()
+
+	topic.startOverlap()
+	defer topic.endOverlap()
+
+	err := target.adoptTopic(ctx, topic)
+	if err != nil {
+		return fmt.Errorf("move topic %q: %w", topic.Name, err)
+	}
+
+	moved, err = source.releaseTopic(ctx, topic)
+	if !moved {
+		// unlistened on the source while moving, so it should not stay on the target either
+		_ = target.Unlisten(topic.Name)
+		return nil
+	}
+
+	// panics are reported by the connection delivering the topic from now on
+	topic.setCallback(target.wrap(topic.callback))
+	startErr := target.delivery.start(topic)
+	if startErr != nil && err == nil {
+		err = startErr
+	}
+
+	p.statsMutex.Lock()
+	p.stats.MovedTopics++
+	p.statsMutex.Unlock()
+
+	select {
+	case <-topic.done:
+		// unlistened on the target while moving
+		_ = target.Unlisten(topic.Name)
+	default:
+	}
+
+	if err != nil {
+		return fmt.Errorf("move topic %q: %w", topic.Name, err)
+	}
+	return nil
+}
+
+// retireConnection removes the connection from the pool and closes it, unless it has topics.
+// New topics can no longer be reserved for it once it is removed. It is closed without holding
+// the registry, as its callbacks may still be using the pool
+func (p *Pool) retireConnection(ctx context.Context, conn *Conn) (bool, error) {
+	p.registry.mutex.Lock()
+	p.connectionsMutex.Lock()
+	delete(p.draining, conn)
+	// topics may still be reserved for it
+	if p.registry.slots[conn] > 0 || conn.Count() > 0 {
+		p.connectionsMutex.Unlock()
+		p.registry.mutex.Unlock()
+		return false, nil
+	}
+	for i, c := range p.connections {
+		if c == conn {
+			p.connections = append(p.connections[:i], p.connections[i+1:]...)
+			break
+		}
+	}
+	p.connectionsMutex.Unlock()
+	p.registry.mutex.Unlock()
+
+	// no longer part of the pool state
+	p.stateMutex.Lock()
+	delete(p.connStates, conn)
+	p.stateMutex.Unlock()
+
+	p.statsMutex.Lock()
+	p.stats.ClosedConnections++
+	p.statsMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, retireTimeout)
+	defer cancel()
+
+	err := conn.Close(ctx)
+	if err != nil {
+		return true, fmt.Errorf("close connection: %w", err)
+	}
+	return true, nil
+}
+
+// startCompaction runs Compact every CompactInterval until stopCompaction,
+// runningMutex must be held
+func (p *Pool) startCompaction() {
+	if p.CompactInterval <= 0 || p.compactStop != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	p.compactStop = stop
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		ticker := time.NewTicker(p.CompactInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-stop:
+				return
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			err := p.Compact(ctx)
+			cancel()
+
+			if err != nil && !errors.Is(err, ErrClosed) {
+				p.OnError(nil, fmt.Errorf("compact: %w", err), nil)
+			}
+		}
+	}()
+}
+
+// stopCompaction stops the goroutine started by startCompaction, runningMutex must be held
+func (p *Pool) stopCompaction() {
+	if p.compactStop == nil {
+		return
+	}
+	close(p.compactStop)
+	p.compactStop = nil
+}
@@ -0,0 +1,223 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startTestPool starts a pool on the fake server and closes it when the test ends
+func startTestPool(t *testing.T, fs *fakeServer, opts ...Option) *Pool {
+	t.Helper()
+
+	pool := NewPoolWithOptions("token", nil, append([]Option{WithURL(fs.url())}, opts...)...)
+	pool.OnError = func(conn *Conn, err error, info interface{}) {
+		t.Errorf("pool error: %v", err)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	})
+	return pool
+}
+
+// waitListening waits until the server has every topic listened to on some client
+func waitListening(t *testing.T, fs *fakeServer, topics ...string) {
+	t.Helper()
+	waitFor(t, 2*time.Second, func() bool {
+		fs.mutex.Lock()
+		clients := append([]*fakeClient(nil), fs.clients...)
+		fs.mutex.Unlock()
+
+		for _, topic := range topics {
+			found := false
+			for _, fc := range clients {
+				found = found || fc.listening(topic)
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// listenTwoConnections listens to a full connection and one more topic on a second one,
+// then unlistens one topic of the first so the second can be compacted onto it
+func listenTwoConnections(t *testing.T, fs *fakeServer, pool *Pool, callback TopicCallback) []string {
+	t.Helper()
+
+	names := make([]string, 0, maxTopics+1)
+	for i := 0; i <= maxTopics; i++ {
+		names = append(names, fmt.Sprintf("topic.%d", i))
+	}
+	if _, err := pool.ListenMany(callback, names...); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Stats().Connections; n != 2 {
+		t.Fatalf("%d connections, want 2", n)
+	}
+	if err := pool.Unlisten(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	names = names[1:]
+	waitListening(t, fs, names...)
+	waitFor(t, 2*time.Second, func() bool {
+		return pool.State() == StateConnected
+	})
+	return names
+}
+
+func TestPoolCompactMoveLosesNoMessages(t *testing.T) {
+	fs := newFakeServer(t)
+	pool := startTestPool(t, fs)
+
+	var mutex sync.Mutex
+	seen := make(map[string]int)
+	names := listenTwoConnections(t, fs, pool, func(data MessageData) {
+		mutex.Lock()
+		seen[data.Topic+"/"+data.Message]++
+		mutex.Unlock()
+	})
+	// the only topic on the second connection
+	moved := names[len(names)-1]
+
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		i := 0
+		defer func() { sent <- i }()
+		for ; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			fs.broadcast(moved, fmt.Sprint(i))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if err := pool.Compact(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	total := <-sent
+
+	if stats := pool.Stats(); stats.Connections != 1 || stats.MovedTopics != 1 {
+		t.Errorf("stats = %+v, want 1 connection and 1 moved topic", stats)
+	}
+	waitFor(t, 2*time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(seen) == total
+	})
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := 0; i < total; i++ {
+		if n := seen[fmt.Sprintf("%s/%d", moved, i)]; n != 1 {
+			t.Errorf("message %d delivered %d times", i, n)
+		}
+	}
+	t.Logf("%d messages sent around the move", total)
+}
+
+func TestPoolCompactRetiresWithRunningCallback(t *testing.T) {
+	fs := newFakeServer(t)
+	pool := startTestPool(t, fs, WithDeliveryMode(DeliveryUnordered))
+
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	names := listenTwoConnections(t, fs, pool, func(data MessageData) {
+		once.Do(func() {
+			close(entered)
+			<-release
+			// the pool must stay usable while the connection is being retired
+			pool.IsListening(data.Topic)
+		})
+	})
+	moved := names[len(names)-1]
+
+	fs.broadcast(moved, "message")
+	<-entered
+
+	compacted := make(chan error, 1)
+	go func() {
+		compacted <- pool.Compact(context.Background())
+	}()
+	waitFor(t, 2*time.Second, func() bool {
+		return pool.Stats().ClosedConnections == 1
+	})
+
+	// the retired connection is waiting for the callback, which needs the pool
+	close(release)
+	select {
+	case err := <-compacted:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Compact did not return")
+	}
+
+	if !pool.IsListening(moved) {
+		t.Errorf("pool not listening to %s after the move", moved)
+	}
+	if _, err := pool.Listen("topic.new", nil); err != nil {
+		t.Errorf("listen after compact: %v", err)
+	}
+}
+
+func TestPoolMaxConnections(t *testing.T) {
+	pool := NewPoolWithOptions("token", nil, WithURL("ws://127.0.0.1:0"))
+	pool.MaxConnections = 1
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	names := make([]string, 0, maxTopics)
+	for i := 0; i < maxTopics; i++ {
+		names = append(names, fmt.Sprintf("topic.%d", i))
+	}
+	if _, err := pool.ListenMany(nil, names...); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := pool.Listen("topic.full", nil); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("listen = %v, want %v", err, ErrTooManyConnections)
+	}
+	if _, err := pool.ListenMany(nil, "topic.full", "topic.full2"); !errors.Is(err, ErrTooManyConnections) {
+		t.Errorf("listen many = %v, want %v", err, ErrTooManyConnections)
+	}
+	if pool.IsListening("topic.full") || pool.IsListening("topic.full2") {
+		t.Error("topic kept after ErrTooManyConnections")
+	}
+	if n := pool.Stats().Connections; n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+
+	// room again once a topic is gone
+	if err := pool.Unlisten(names[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pool.Listen("topic.full", nil); err != nil {
+		t.Errorf("listen after unlisten: %v", err)
+	}
+}
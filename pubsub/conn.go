@@ -1,21 +1,80 @@
 package pubsub
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 )
 
+// Pool defaults
+const (
+	// How long Run waits for the pool to close
+	defaultShutdownTimeout = time.Second * 10
+)
+
+// ErrTooManyConnections is when a topic needs a new connection but the Pool already has MaxConnections.
+var ErrTooManyConnections = errors.New("too many connections")
+
 // Pool is something
 type Pool struct {
 	running      bool
+	closed       bool
 	runningMutex sync.Mutex
 
 	connections      []*Conn
 	connectionsMutex sync.RWMutex
+	// Every topic and its connection, locked before connectionsMutex
+	registry *topicRegistry
+	// Connections being compacted, no topics are added to them
+	draining map[*Conn]struct{}
+
+	// Compaction goroutine, stopped by closing compactStop
+	compactStop  chan struct{}
+	compactMutex sync.Mutex
+	wg           waitGroup
 
 	authToken string
 	header    http.Header
+	options   []Option
+
+	subscribers      map[string]*subscriberSet
+	subscribersMutex sync.Mutex
+	chanBuffer       int
+
+	mux *Mux
+
+	accounts      map[TokenSource]map[string]struct{}
+	accountsMutex sync.Mutex
+
+	// Shared by all connections, so a topic that moves between them is still deduplicated
+	events *dedupeCache
+	// Shared by all connections, so together they stay within the rate limit
+	limiter *rateLimiter
+
+	state      State
+	connStates map[*Conn]State
+	stateMutex sync.Mutex
+
+	// Errors that make Run stop the pool
+	fatal chan error
+
+	stats      PoolStats
+	statsMutex sync.Mutex
+
+	// Reconnect policy given to every connection, nil keeps the Conn default
+	ReconnectPolicy ReconnectPolicy
+	// How long Run waits for the pool to close once it is stopping
+	ShutdownTimeout time.Duration
+	// Most connections the pool opens, 0 for no limit, the default. Twitch allows 10
+	// connections per IP, at 50 topics each. Once reached, topics that need a new
+	// connection fail with ErrTooManyConnections
+	MaxConnections int
+	// How often topics of sparsely used connections are moved onto the others, see Compact.
+	// 0 disables it, the default. Changes take effect on the next Start
+	CompactInterval time.Duration
 
 	// Called on pool start
 	OnStart func()
@@ -23,107 +82,275 @@ type Pool struct {
 	OnConnect func(conn *Conn)
 	// Called on errors
 	OnError func(*Conn, error, interface{})
+	// Called when an individual connection loses its connection
+	OnDisconnect func(conn *Conn, reason StateReason)
+	// Called when the state of the pool changes
+	OnStateChange func(from, to State, reason StateReason)
 }
 
 // NewPool is something
 func NewPool(authToken string, header http.Header) *Pool {
+	return NewPoolWithOptions(authToken, header)
+}
+
+// NewPoolWithOptions creates a Pool whose connections all share the given options
+func NewPoolWithOptions(authToken string, header http.Header, opts ...Option) *Pool {
+	o := newOptions(opts)
+
 	return &Pool{
 		running:     false,
 		connections: make([]*Conn, 0),
+		draining:    make(map[*Conn]struct{}),
+		registry:    newTopicRegistry(),
 		authToken:   authToken,
 		header:      header,
+		options:     append([]Option(nil), opts...),
+		subscribers: make(map[string]*subscriberSet),
+		chanBuffer:  o.chanBuffer,
+		mux:         NewMux(),
+		accounts:    make(map[TokenSource]map[string]struct{}),
+		events:      o.newEventCache(),
+		limiter:     o.newRateLimiter(),
+		state:       StateIdle,
+		connStates:  make(map[*Conn]State),
+		fatal:       make(chan error, 1),
+
+		ShutdownTimeout: defaultShutdownTimeout,
 
-		OnStart:   func() {},
-		OnConnect: func(conn *Conn) {},
-		OnError:   func(conn *Conn, err error, info interface{}) {},
+		OnStart:       func() {},
+		OnConnect:     func(conn *Conn) {},
+		OnError:       func(conn *Conn, err error, info interface{}) {},
+		OnDisconnect:  func(conn *Conn, reason StateReason) {},
+		OnStateChange: func(from, to State, reason StateReason) {},
 	}
 }
 
+// getTopicByName looks the topic up in the registry
 func (p *Pool) getTopicByName(name string) (*Topic, *Conn) {
-	p.connectionsMutex.RLock()
-	defer p.connectionsMutex.RUnlock()
-	for _, conn := range p.connections {
-		topic := conn.getTopicByName(name)
-		if topic != nil {
-			return topic, conn
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+
+	entry := p.registry.entries[name]
+	if entry == nil {
+		return nil, nil
+	}
+	if entry.topic == nil {
+		// reserved, the connection may have it already while waiting for Twitch
+		if topic := entry.conn.getTopicByName(name); topic != nil {
+			return topic, entry.conn
 		}
+		return nil, nil
+	}
+	// a moving topic may already be gone from its old connection
+	if entry.next != nil && entry.conn.getTopicByName(name) != entry.topic {
+		return entry.topic, entry.next
 	}
-	return nil, nil
+	return entry.topic, entry.conn
 }
 
-func (p *Pool) createNewConnection() *Conn {
+func (p *Pool) createNewConnection() (*Conn, error) {
 	p.connectionsMutex.Lock()
 	defer p.connectionsMutex.Unlock()
 
+	if p.MaxConnections > 0 && len(p.connections) >= p.MaxConnections {
+		return nil, ErrTooManyConnections
+	}
+
 	// create and configure connection
-	newConn := NewConn(p.authToken, p.header)
+	newConn := NewConnWithOptions(p.authToken, p.header, p.options...)
+	if p.ReconnectPolicy != nil {
+		newConn.SetReconnectPolicy(p.ReconnectPolicy)
+	}
 	newConn.OnConnect = func() {
 		p.OnConnect(newConn)
 	}
 	newConn.OnError = func(err error, info interface{}) {
 		p.OnError(newConn, err, info)
+		if errors.Is(err, ErrReconnectGaveUp) {
+			p.reportFatal(err)
+		}
+	}
+	newConn.onTokenRefresh = func(rejected, token string) {
+		p.relistenWithToken(newConn, rejected, token)
+	}
+	newConn.OnStateChange = func(from, to State, reason StateReason) {
+		p.connStateChanged(newConn, from, to, reason)
 	}
+	newConn.onTopicRemoved = p.untrackTopic
+	newConn.events = p.events
+	newConn.limiter = p.limiter
 	p.connections = append(p.connections, newConn)
 
-	// start the new connection if already running
-	p.runningMutex.Lock()
-	if p.running {
-		err := newConn.Start()
-		if err != nil {
-			p.OnError(newConn, err, nil)
-		}
+	p.stateMutex.Lock()
+	p.connStates[newConn] = StateIdle
+	p.stateMutex.Unlock()
+
+	return newConn, nil
+}
+
+// State returns the state of the pool. While running it is connected when every
+// connection is, and reconnecting while any of them is.
+func (p *Pool) State() State {
+	p.stateMutex.Lock()
+	defer p.stateMutex.Unlock()
+	return p.state
+}
+
+func (p *Pool) setState(state State, reason StateReason) {
+	p.stateMutex.Lock()
+	old := p.state
+	p.state = state
+	if state == StateConnected {
+		p.state = p.runningState()
 	}
-	p.runningMutex.Unlock()
+	state = p.state
+	p.stateMutex.Unlock()
+
+	if old != state {
+		p.OnStateChange(old, state, reason)
+	}
+}
+
+// connStateChanged updates the pool state after a connection changed its own.
+// Connections closed by Compact are no longer part of the pool and are ignored
+func (p *Pool) connStateChanged(conn *Conn, from, state State, reason StateReason) {
+	p.stateMutex.Lock()
+	if _, ok := p.connStates[conn]; !ok {
+		p.stateMutex.Unlock()
+		return
+	}
+	p.connStates[conn] = state
+	old := p.state
+	if old == StateConnected || old == StateReconnecting {
+		p.state = p.runningState()
+	}
+	state = p.state
+	p.stateMutex.Unlock()
+
+	if from == StateConnected {
+		p.OnDisconnect(conn, reason)
+	}
+	if old != state {
+		p.OnStateChange(old, state, reason)
+	}
+}
 
-	return newConn
+// runningState is the state of a started pool, stateMutex must be held
+func (p *Pool) runningState() State {
+	for _, state := range p.connStates {
+		if state == StateReconnecting {
+			return StateReconnecting
+		}
+	}
+	return StateConnected
 }
 
-func (p *Pool) getTargetConnection() (targetConnection *Conn) {
+// relistenWithToken hands a refreshed token to every other connection using the rejected one
+func (p *Pool) relistenWithToken(source *Conn, rejected, token string) {
 	p.connectionsMutex.RLock()
-	if len(p.connections) == 0 {
-		// No connections yet
-		p.connectionsMutex.RUnlock()
-		targetConnection = p.createNewConnection()
-	} else {
-		// find first connection with available space
-		for _, conn := range p.connections {
-			if conn.Capacity() > 0 {
-				targetConnection = conn
-				p.connectionsMutex.RUnlock()
-				return
-			}
+	defer p.connectionsMutex.RUnlock()
+	for _, conn := range p.connections {
+		if conn != source {
+			conn.relistenWithToken(rejected, token)
 		}
+	}
+}
 
-		// must create new connection now
-		p.connectionsMutex.RUnlock()
-		targetConnection = p.createNewConnection()
+func (p *Pool) isClosed() bool {
+	p.runningMutex.Lock()
+	defer p.runningMutex.Unlock()
+	return p.closed
+}
+
+// Use adds middleware for topics listened to after this call, on current and future connections
+func (p *Pool) Use(middleware ...Middleware) {
+	p.connectionsMutex.Lock()
+	defer p.connectionsMutex.Unlock()
+
+	p.options = append(p.options, WithMiddleware(middleware...))
+	for _, conn := range p.connections {
+		conn.Use(middleware...)
 	}
-	return
 }
 
-// Listen is something
+// Handle routes messages on topics starting with the prefix to the handler, see Mux.Handle
+func (p *Pool) Handle(prefix string, handler TopicCallback) {
+	p.mux.Handle(prefix, handler)
+}
+
+// HandleType routes messages of the inner type to the handler, see Mux.HandleType
+func (p *Pool) HandleType(messageType string, handler TopicCallback) {
+	p.mux.HandleType(messageType, handler)
+}
+
+// HandleNotFound sets the handler for routed messages that match nothing else
+func (p *Pool) HandleNotFound(handler TopicCallback) {
+	p.mux.HandleNotFound(handler)
+}
+
+// route returns the callback, or the Pool's mux when no callback was given
+func (p *Pool) route(callback TopicCallback) TopicCallback {
+	if callback == nil {
+		return p.mux.ServeMessage
+	}
+	return callback
+}
+
+// Listen is something. A nil callback routes messages through the handlers
+// registered with Handle, HandleType and HandleNotFound.
 func (p *Pool) Listen(topic string, callback TopicCallback) (*Topic, error) {
-	if t, _ := p.getTopicByName(topic); t != nil {
-		return nil, fmt.Errorf("listen topic %s: %w", topic, ErrDuplicateTopic)
+	return p.ListenWithTokenSource(topic, nil, callback)
+}
+
+// ListenContext listens to a topic on a connection with space and waits for Twitch to acknowledge it
+func (p *Pool) ListenContext(ctx context.Context, topic string, callback TopicCallback) (*Topic, error) {
+	if p.isClosed() {
+		return nil, fmt.Errorf("listen topic %s: %w", topic, ErrClosed)
+	}
+	callback = p.route(callback)
+
+	return p.listenReserved(topic, func(conn *Conn) (*Topic, error) {
+		return conn.ListenContext(ctx, topic, callback)
+	})
+}
+
+// ListenMany is something. The topics are grouped per connection, so each one can
+// listen to its share in batches
+func (p *Pool) ListenMany(callback TopicCallback, topics ...string) ([]*Topic, error) {
+	if p.isClosed() {
+		return nil, fmt.Errorf("listen topics: %w", ErrClosed)
 	}
+	callback = p.route(callback)
 
-	targetConnection := p.getTargetConnection()
-	t, err := targetConnection.Listen(topic, callback)
+	conns, err := p.reserve(topics...)
 	if err != nil {
 		return nil, err
 	}
-	return t, nil
-}
 
-// ListenMany is something
-func (p *Pool) ListenMany(callback TopicCallback, topics ...string) ([]*Topic, error) {
 	var returnedTopics []*Topic
-	for _, topic := range topics {
-		t, err := p.Listen(topic, callback)
+	for len(topics) > 0 {
+		// topics placed on the same connection are listened to together
+		conn := conns[0]
+		n := 1
+		for n < len(topics) && conns[n] == conn {
+			n++
+		}
+
+		_, err = conn.ListenMany(callback, topics[:n]...)
+		// topics added before an error stay listened to, as with Listen
+		for _, topic := range topics[:n] {
+			if t := p.settle(conn, topic); t != nil {
+				returnedTopics = append(returnedTopics, t)
+			}
+		}
+		topics, conns = topics[n:], conns[n:]
+
 		if err != nil {
+			for _, topic := range topics {
+				p.registry.cancel(topic)
+			}
 			return nil, err
 		}
-		returnedTopics = append(returnedTopics, t)
 	}
 	return returnedTopics, nil
 }
@@ -142,6 +369,16 @@ func (p *Pool) Unlisten(topic string) error {
 	return nil
 }
 
+// UnlistenContext unlistens a topic and waits for Twitch to acknowledge it
+func (p *Pool) UnlistenContext(ctx context.Context, topic string) error {
+	t, conn := p.getTopicByName(topic)
+	if t == nil {
+		return fmt.Errorf("unlisten topic %s: %w", topic, ErrInvalidTopic)
+	}
+
+	return conn.UnlistenContext(ctx, topic)
+}
+
 // UnlistenMany is something
 func (p *Pool) UnlistenMany(topics ...string) error {
 	for _, topic := range topics {
@@ -164,16 +401,24 @@ func (p *Pool) Start() (err error) {
 	p.runningMutex.Lock()
 	defer p.runningMutex.Unlock()
 
+	if p.closed {
+		return ErrClosed
+	}
 	if p.running {
 		return
 	}
 
+	p.setState(StateConnecting, StateReason{})
+
 	p.connectionsMutex.RLock()
 	defer func() {
 		p.connectionsMutex.RUnlock()
-		if err == nil {
-			p.OnStart()
+		if err != nil {
+			p.setState(StateClosed, StateReason{Err: err})
+			return
 		}
+		p.setState(StateConnected, StateReason{})
+		p.OnStart()
 	}()
 
 	for _, conn := range p.connections {
@@ -184,6 +429,7 @@ func (p *Pool) Start() (err error) {
 	}
 
 	p.running = true
+	p.startCompaction()
 	return
 }
 
@@ -196,12 +442,75 @@ func (p *Pool) Stop() {
 		return
 	}
 
+	// closed first, so the connections going down do not count as reconnecting
+	p.setState(StateClosed, StateReason{})
+
 	p.connectionsMutex.RLock()
 	defer p.connectionsMutex.RUnlock()
 	for _, conn := range p.connections {
 		conn.Stop()
 	}
 
+	p.stopCompaction()
 	p.running = false
 	return
 }
+
+// Close stops the pool for good, closing every connection and waiting for their goroutines
+// until ctx is done. Returns the first error from a connection
+func (p *Pool) Close(ctx context.Context) (err error) {
+	p.runningMutex.Lock()
+	p.running = false
+	p.closed = true
+	p.stopCompaction()
+	p.runningMutex.Unlock()
+
+	p.setState(StateClosed, StateReason{})
+
+	// a compaction in progress gives up before the connections close
+	if waitErr := p.wg.Wait(ctx); waitErr != nil {
+		err = waitErr
+	}
+
+	p.connectionsMutex.RLock()
+	connections := append([]*Conn(nil), p.connections...)
+	p.connectionsMutex.RUnlock()
+
+	for _, conn := range connections {
+		closeErr := conn.Close(ctx)
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return
+}
+
+// reportFatal hands an error to Run, only the first one is kept
+func (p *Pool) reportFatal(err error) {
+	select {
+	case p.fatal <- err:
+	default:
+	}
+}
+
+// Run starts the pool and blocks until ctx is done or a connection gives up reconnecting.
+// The pool is then closed, waiting up to ShutdownTimeout for running callbacks to finish.
+// Returns what stopped the pool: ctx.Err(), the fatal error or the error from Start.
+func (p *Pool) Run(ctx context.Context) (err error) {
+	err = p.Start()
+	if err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case err = <-p.fatal:
+		}
+	}
+
+	shutdown, cancel := context.WithTimeout(context.Background(), p.ShutdownTimeout)
+	defer cancel()
+	closeErr := p.Close(shutdown)
+	if closeErr != nil {
+		p.OnError(nil, fmt.Errorf("close pool: %w", closeErr), nil)
+	}
+	return
+}
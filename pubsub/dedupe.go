@@ -0,0 +1,112 @@
+package pubsub
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Default limits for WithDeduplication
+const (
+	defaultDedupeWindow = time.Minute * 10
+	defaultDedupeSize   = 10000
+)
+
+// dedupeCache remembers keys for a while, so repeated keys can be recognised
+type dedupeCache struct {
+	size   int
+	window time.Duration
+
+	entries map[string]*list.Element
+	order   *list.List
+	hits    int64
+	mutex   sync.Mutex
+}
+
+type dedupeEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+func newDedupeCache(size int, window time.Duration) *dedupeCache {
+	return &dedupeCache{
+		size:    size,
+		window:  window,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// seen records the key and reports whether it was already recorded within the window
+func (d *dedupeCache) seen(key string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	d.evict(now)
+
+	if _, ok := d.entries[key]; ok {
+		d.hits++
+		return true
+	}
+
+	d.entries[key] = d.order.PushBack(&dedupeEntry{key: key, seenAt: now})
+	if d.order.Len() > d.size {
+		d.remove(d.order.Front())
+	}
+	return false
+}
+
+// Hits returns how many keys were recognised as repeated
+func (d *dedupeCache) Hits() int64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.hits
+}
+
+// evict drops entries older than the window, the oldest are at the front
+func (d *dedupeCache) evict(now time.Time) {
+	for front := d.order.Front(); front != nil; front = d.order.Front() {
+		if now.Sub(front.Value.(*dedupeEntry).seenAt) < d.window {
+			return
+		}
+		d.remove(front)
+	}
+}
+
+func (d *dedupeCache) remove(element *list.Element) {
+	d.order.Remove(element)
+	delete(d.entries, element.Value.(*dedupeEntry).key)
+}
+
+// identityFields are the parts of a message that identify the event it is about
+type identityFields struct {
+	Type      string `json:"type"`
+	MessageID string `json:"message_id"`
+	Data      struct {
+		Redemption struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		} `json:"redemption"`
+	} `json:"data"`
+}
+
+// eventIdentity returns a key for the event the message is about, such as the bits
+// message_id or the redemption ID. Other messages are identified by their content.
+func eventIdentity(data MessageData) string {
+	fields := identityFields{}
+	if json.Unmarshal([]byte(data.Message), &fields) == nil {
+		switch {
+		case fields.MessageID != "":
+			return data.Topic + "|" + fields.MessageID
+		case fields.Data.Redemption.ID != "":
+			return data.Topic + "|" + fields.Type + "|" + fields.Data.Redemption.ID + "|" + fields.Data.Redemption.Status
+		}
+	}
+
+	sum := sha256.Sum256([]byte(data.Message))
+	return data.Topic + "|" + hex.EncodeToString(sum[:])
+}
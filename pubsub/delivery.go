@@ -0,0 +1,242 @@
+package pubsub
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Default values for message delivery
+const (
+	defaultDeliveryQueueSize = 64
+	defaultDeliveryWorkers   = 4
+	defaultChanBuffer        = 64
+)
+
+// DeliveryMode controls how messages reach topic callbacks
+type DeliveryMode int
+
+const (
+	// DeliveryOrdered runs one worker per topic, so each callback sees its messages in order
+	DeliveryOrdered DeliveryMode = iota
+	// DeliveryUnordered starts a goroutine for every message
+	DeliveryUnordered
+	// DeliveryWorkerPool shares a fixed number of workers between all topics of a connection
+	DeliveryWorkerPool
+)
+
+// OverflowPolicy decides what happens when a delivery queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for space, which stops reading from the websocket in the meantime
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropOldest throws away the oldest queued message to make room
+	OverflowDropOldest
+	// OverflowReport drops the new message and reports ErrQueueFull through OnError
+	OverflowReport
+)
+
+// job is a single message waiting for its topic callback
+type job struct {
+	topic *Topic
+	data  MessageData
+}
+
+// delivery hands incoming messages to topic callbacks according to the DeliveryMode
+type delivery struct {
+	mode      DeliveryMode
+	overflow  OverflowPolicy
+	queueSize int
+	workers   int
+
+	jobs         chan job
+	done         chan struct{}
+	workersStart sync.Once
+
+	// Workers and running callbacks, no more are added once closed
+	wg          waitGroup
+	closed      bool
+	closedMutex sync.RWMutex
+
+	// Called when a message is dropped because of OverflowReport
+	onOverflow func(j job)
+}
+
+func newDelivery(o *options) *delivery {
+	d := &delivery{
+		mode:      o.deliveryMode,
+		overflow:  o.overflowPolicy,
+		queueSize: o.deliveryQueueSize,
+		workers:   o.deliveryWorkers,
+
+		done: make(chan struct{}),
+
+		onOverflow: func(j job) {},
+	}
+	if d.queueSize <= 0 {
+		d.queueSize = defaultDeliveryQueueSize
+	}
+	if d.workers <= 0 {
+		d.workers = defaultDeliveryWorkers
+	}
+	if d.mode == DeliveryWorkerPool {
+		d.jobs = make(chan job, d.queueSize)
+	}
+	return d
+}
+
+// start prepares delivery for a newly registered topic, or takes over delivery for a topic
+// that moved from another connection
+func (d *delivery) start(t *Topic) error {
+	if t.done == nil {
+		t.done = make(chan struct{})
+	}
+	if d.mode != DeliveryOrdered {
+		return nil
+	}
+	if !d.add() {
+		return ErrClosed
+	}
+
+	// a moved topic keeps its queue, so nothing queued is lost or reordered
+	if t.queue == nil {
+		t.queue = make(chan job, d.queueSize)
+	}
+	stop := make(chan struct{})
+	exited := make(chan struct{})
+	t.workerStop = stop
+	t.workerExited = exited
+	go func() {
+		defer d.wg.Done()
+		defer close(exited)
+		for {
+			select {
+			case j := <-t.queue:
+				j.topic.call(j.data)
+			case <-t.done:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// detach stops the worker of a topic that moves to another connection, leaving its queue
+// for the worker started there. Waits for a running callback to return
+func (d *delivery) detach(t *Topic) {
+	if t.workerStop == nil {
+		return
+	}
+	close(t.workerStop)
+	<-t.workerExited
+	t.workerStop = nil
+	t.workerExited = nil
+}
+
+// stop ends delivery for a removed topic, dropping anything still queued
+func (d *delivery) stop(t *Topic) {
+	if t.done == nil {
+		return
+	}
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+func (d *delivery) deliver(t *Topic, data MessageData) {
+	j := job{topic: t, data: data}
+
+	switch d.mode {
+	case DeliveryUnordered:
+		if !d.add() {
+			return
+		}
+		go func() {
+			defer d.wg.Done()
+			t.call(data)
+		}()
+	case DeliveryWorkerPool:
+		d.workersStart.Do(d.startWorkers)
+		d.enqueue(d.jobs, j, d.done)
+	default:
+		d.enqueue(t.queue, j, t.done)
+	}
+}
+
+func (d *delivery) startWorkers() {
+	for i := 0; i < d.workers; i++ {
+		if !d.add() {
+			return
+		}
+		go func() {
+			defer d.wg.Done()
+			for {
+				select {
+				case j := <-d.jobs:
+					j.topic.call(j.data)
+				case <-d.done:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (d *delivery) enqueue(queue chan job, j job, done chan struct{}) {
+	switch d.overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case queue <- j:
+				return
+			default:
+			}
+
+			select {
+			case <-queue:
+			default:
+			}
+		}
+	case OverflowReport:
+		select {
+		case queue <- j:
+		default:
+			d.onOverflow(j)
+		}
+	default:
+		select {
+		case queue <- j:
+		case <-done:
+		}
+	}
+}
+
+// add counts another goroutine in wg, unless delivery was closed
+func (d *delivery) add() bool {
+	d.closedMutex.RLock()
+	defer d.closedMutex.RUnlock()
+	if d.closed {
+		return false
+	}
+	d.wg.Add(1)
+	return true
+}
+
+// close stops the shared workers, topics are stopped separately. Running callbacks
+// are waited for with wg
+func (d *delivery) close() {
+	d.closedMutex.Lock()
+	defer d.closedMutex.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	close(d.done)
+}
+
+// overflowError is the error reported for a message dropped by OverflowReport
+func overflowError(j job) error {
+	return fmt.Errorf("deliver message for topic %q: %w", j.topic.Name, ErrQueueFull)
+}
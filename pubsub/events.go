@@ -0,0 +1,102 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownMessageType is when a message has a type the decoder does not know about
+var ErrUnknownMessageType = errors.New("unknown message type")
+
+// Event is a decoded PubSub message
+type Event interface {
+	// MessageType returns the inner type of the message, e.g. "reward-redeemed"
+	MessageType() string
+}
+
+// eventHeader is the part shared by messages that carry their type in a "type" field
+type eventHeader struct {
+	Type string `json:"type"`
+}
+
+// decodeEvent unmarshals the message into the event registered for its inner type
+func decodeEvent(data MessageData, events map[string]func() Event) (Event, error) {
+	header := eventHeader{}
+	err := json.Unmarshal([]byte(data.Message), &header)
+	if err != nil {
+		return nil, fmt.Errorf("decode message on %s: %w", data.Topic, err)
+	}
+
+	newEvent, ok := events[header.Type]
+	if !ok {
+		return nil, fmt.Errorf("decode message on %s: %q: %w", data.Topic, header.Type, ErrUnknownMessageType)
+	}
+
+	event := newEvent()
+	err = json.Unmarshal([]byte(data.Message), event)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s message on %s: %w", header.Type, data.Topic, err)
+	}
+	return event, nil
+}
+
+// rawEvent is a message whose data may arrive as an object or as a JSON encoded string
+type rawEvent struct {
+	Type       string          `json:"type"`
+	Data       json.RawMessage `json:"data"`
+	DataObject json.RawMessage `json:"data_object"`
+}
+
+// decodeRawEvent reads the outer message, leaving the data to be decoded by the caller
+func decodeRawEvent(data MessageData) (rawEvent, error) {
+	raw := rawEvent{}
+	err := json.Unmarshal([]byte(data.Message), &raw)
+	if err != nil {
+		return raw, fmt.Errorf("decode message on %s: %w", data.Topic, err)
+	}
+	return raw, nil
+}
+
+// decodeData unmarshals the data into v, unwrapping it first if it was sent as a string
+func (r rawEvent) decodeData(v interface{}) error {
+	data := r.Data
+	if len(r.DataObject) > 0 && string(r.DataObject) != "null" {
+		data = r.DataObject
+	}
+
+	if len(data) > 0 && data[0] == '"' {
+		var inner string
+		err := json.Unmarshal(data, &inner)
+		if err != nil {
+			return err
+		}
+		data = json.RawMessage(inner)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// messageTypeFields are the fields Twitch uses for the inner type, depending on the topic
+type messageTypeFields struct {
+	Type        string `json:"type"`
+	MessageType string `json:"message_type"`
+	Context     string `json:"context"`
+}
+
+// PeekMessageType returns the inner type of a message without decoding the rest of it.
+// Bits events carry it as "message_type" and subscription events as "context".
+func PeekMessageType(data MessageData) string {
+	fields := messageTypeFields{}
+	if json.Unmarshal([]byte(data.Message), &fields) != nil {
+		return ""
+	}
+
+	switch {
+	case fields.Type != "":
+		return fields.Type
+	case fields.MessageType != "":
+		return fields.MessageType
+	default:
+		return fields.Context
+	}
+}
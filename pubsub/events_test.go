@@ -0,0 +1,300 @@
+package pubsub
+
+import (
+	"testing"
+	"time"
+)
+
+// mustTime parses an RFC 3339 timestamp from a sample payload
+func mustTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+func TestDecodeBits(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		message string
+		check   func(t *testing.T, e *BitsEvent)
+	}{
+		{
+			name:    "cheer with badge entitlement",
+			topic:   "channel-bits-events-v2.46024993",
+			message: `{"data":{"user_name":"jwp","channel_name":"bontakun","user_id":"95546976","channel_id":"46024993","time":"2017-02-09T13:23:58.168Z","chat_message":"cheer10000 New badge hype!","bits_used":10000,"total_bits_used":25000,"is_anonymous":false,"context":"cheer","badge_entitlement":{"new_version":25000,"previous_version":10000}},"version":"1.0","message_type":"bits_event","message_id":"8145728a4-35f0-4cf7-9dc0-f2ef24de1eb6"}`,
+			check: func(t *testing.T, e *BitsEvent) {
+				if e.Data.UserName != "jwp" || e.Data.UserID != "95546976" {
+					t.Errorf("user = %s/%s, want jwp/95546976", e.Data.UserName, e.Data.UserID)
+				}
+				if e.Data.ChannelName != "bontakun" || e.Data.ChannelID != "46024993" {
+					t.Errorf("channel = %s/%s, want bontakun/46024993", e.Data.ChannelName, e.Data.ChannelID)
+				}
+				if e.Data.BitsUsed != 10000 || e.Data.TotalBitsUsed != 25000 {
+					t.Errorf("bits = %d/%d, want 10000/25000", e.Data.BitsUsed, e.Data.TotalBitsUsed)
+				}
+				if e.Data.ChatMessage != "cheer10000 New badge hype!" {
+					t.Errorf("chat message = %q", e.Data.ChatMessage)
+				}
+				if !e.Data.Time.Equal(mustTime(t, "2017-02-09T13:23:58.168Z")) {
+					t.Errorf("time = %v", e.Data.Time)
+				}
+				if e.Anonymous() {
+					t.Error("cheer reported as anonymous")
+				}
+				badge := e.Data.BadgeEntitlement
+				if badge == nil || badge.NewVersion != 25000 || badge.PreviousVersion != 10000 {
+					t.Errorf("badge entitlement = %+v, want 25000 from 10000", badge)
+				}
+				if e.MessageID != "8145728a4-35f0-4cf7-9dc0-f2ef24de1eb6" || e.Version != "1.0" {
+					t.Errorf("message id = %s, version = %s", e.MessageID, e.Version)
+				}
+			},
+		},
+		{
+			name:    "cheer without badge entitlement",
+			topic:   "channel-bits-events-v1.46024993",
+			message: `{"data":{"user_name":"dallasnchains","channel_name":"dallas","user_id":"129454141","channel_id":"44322889","time":"2017-02-09T13:23:58.168Z","chat_message":"cheer10 Test","bits_used":10,"total_bits_used":25,"context":"cheer","badge_entitlement":null},"version":"1.0","message_type":"bits_event","message_id":"8145728a4-35f0-4cf7-9dc0-f2ef24de1eb6"}`,
+			check: func(t *testing.T, e *BitsEvent) {
+				if e.Data.UserName != "dallasnchains" || e.Data.BitsUsed != 10 || e.Data.TotalBitsUsed != 25 {
+					t.Errorf("decoded %s with %d/%d bits", e.Data.UserName, e.Data.BitsUsed, e.Data.TotalBitsUsed)
+				}
+				if e.Data.BadgeEntitlement != nil {
+					t.Errorf("badge entitlement = %+v, want nil", e.Data.BadgeEntitlement)
+				}
+				if e.Anonymous() {
+					t.Error("cheer reported as anonymous")
+				}
+			},
+		},
+		{
+			name:    "anonymous cheer v2",
+			topic:   "channel-bits-events-v2.46024993",
+			message: `{"data":{"user_name":null,"channel_name":"bontakun","user_id":null,"channel_id":"46024993","time":"2019-03-05T21:59:48.262Z","chat_message":"Anon1 hello","bits_used":1,"total_bits_used":0,"is_anonymous":true,"context":"cheer","badge_entitlement":null},"version":"1.0","message_type":"bits_event","message_id":"6c3c0df8-2eb1-5bc5-a1a2-a2f5d3f4f1e4"}`,
+			check: func(t *testing.T, e *BitsEvent) {
+				if !e.Anonymous() || !e.Data.IsAnonymous {
+					t.Error("anonymous cheer not reported as anonymous")
+				}
+				if e.Data.UserName != "" || e.Data.UserID != "" {
+					t.Errorf("user = %s/%s, want none", e.Data.UserName, e.Data.UserID)
+				}
+				if e.Data.BitsUsed != 1 || e.Data.ChatMessage != "Anon1 hello" {
+					t.Errorf("decoded %d bits with %q", e.Data.BitsUsed, e.Data.ChatMessage)
+				}
+			},
+		},
+		{
+			name:    "anonymous cheer v1",
+			topic:   "channel-bits-events-v1.46024993",
+			message: `{"data":{"user_name":"ananonymouscheerer","channel_name":"bontakun","user_id":"407665396","channel_id":"46024993","time":"2019-03-05T21:59:48.262Z","chat_message":"Anon1 hello","bits_used":1,"total_bits_used":1,"context":"cheer","badge_entitlement":null},"version":"1.0","message_type":"bits_event","message_id":"6c3c0df8-2eb1-5bc5-a1a2-a2f5d3f4f1e4"}`,
+			check: func(t *testing.T, e *BitsEvent) {
+				if !e.Anonymous() {
+					t.Error("anonymous cheer not reported as anonymous")
+				}
+				if e.Data.IsAnonymous {
+					t.Error("v1 messages have no is_anonymous field")
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := MessageData{Topic: test.topic, Message: test.message}
+			event, err := DecodeBits(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.MessageType() != TypeBitsEvent {
+				t.Errorf("message type = %q, want %q", event.MessageType(), TypeBitsEvent)
+			}
+			if peeked := PeekMessageType(data); peeked != TypeBitsEvent {
+				t.Errorf("peeked message type = %q, want %q", peeked, TypeBitsEvent)
+			}
+			if event.Data.Context != "cheer" {
+				t.Errorf("context = %q, want cheer", event.Data.Context)
+			}
+			test.check(t, event)
+		})
+	}
+}
+
+func TestDecodeBitsBadgeUnlock(t *testing.T) {
+	data := MessageData{
+		Topic:   "channel-bits-badge-unlocks.232889822",
+		Message: `{"user_id":"232889822","user_name":"willowolf","channel_id":"232889822","channel_name":"willowolf","badge_tier":1000,"chat_message":"this should be received by the public pubsub listener","time":"2020-12-06T00:01:43.71253159Z"}`,
+	}
+	event, err := DecodeBitsBadgeUnlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.UserID != "232889822" || event.UserName != "willowolf" {
+		t.Errorf("user = %s/%s, want willowolf/232889822", event.UserName, event.UserID)
+	}
+	if event.ChannelID != "232889822" || event.ChannelName != "willowolf" {
+		t.Errorf("channel = %s/%s, want willowolf/232889822", event.ChannelName, event.ChannelID)
+	}
+	if event.BadgeTier != 1000 {
+		t.Errorf("badge tier = %d, want 1000", event.BadgeTier)
+	}
+	if event.ChatMessage != "this should be received by the public pubsub listener" {
+		t.Errorf("chat message = %q", event.ChatMessage)
+	}
+	if !event.Time.Equal(mustTime(t, "2020-12-06T00:01:43.71253159Z")) {
+		t.Errorf("time = %v", event.Time)
+	}
+	if event.MessageType() != TypeBitsBadgeUnlock {
+		t.Errorf("message type = %q, want %q", event.MessageType(), TypeBitsBadgeUnlock)
+	}
+}
+
+func TestDecodeSubscription(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		context string
+		gift    bool
+		anon    bool
+		resub   bool
+		multi   bool
+		check   func(t *testing.T, e *SubscribeEvent)
+	}{
+		{
+			name:    "sub",
+			message: `{"user_name":"tww2","display_name":"TWW2","channel_name":"mr_woodchuck","user_id":"13405587","channel_id":"89614178","time":"2015-12-19T16:39:57-08:00","sub_plan":"1000","sub_plan_name":"Channel Subscription (mr_woodchuck)","cumulative_months":9,"streak_months":3,"context":"sub","is_gift":false,"sub_message":{"message":"","emotes":null}}`,
+			context: ContextSub,
+			check: func(t *testing.T, e *SubscribeEvent) {
+				if e.UserName != "tww2" || e.DisplayName != "TWW2" || e.UserID != "13405587" {
+					t.Errorf("user = %s/%s/%s", e.UserName, e.DisplayName, e.UserID)
+				}
+				if e.ChannelName != "mr_woodchuck" || e.ChannelID != "89614178" {
+					t.Errorf("channel = %s/%s", e.ChannelName, e.ChannelID)
+				}
+				if e.SubPlan != "1000" || e.SubPlanName != "Channel Subscription (mr_woodchuck)" {
+					t.Errorf("plan = %s/%s", e.SubPlan, e.SubPlanName)
+				}
+				if e.CumulativeMonths != 9 || e.StreakMonths != 3 {
+					t.Errorf("months = %d/%d, want 9/3", e.CumulativeMonths, e.StreakMonths)
+				}
+				if !e.Time.Equal(mustTime(t, "2015-12-19T16:39:57-08:00")) {
+					t.Errorf("time = %v", e.Time)
+				}
+				if e.RecipientID != "" {
+					t.Errorf("recipient = %s, want none", e.RecipientID)
+				}
+			},
+		},
+		{
+			name:    "resub",
+			message: `{"user_name":"tww2","display_name":"TWW2","channel_name":"mr_woodchuck","user_id":"13405587","channel_id":"89614178","time":"2015-12-19T16:39:57-08:00","sub_plan":"1000","sub_plan_name":"Channel Subscription (mr_woodchuck)","cumulative_months":9,"streak_months":3,"context":"resub","is_gift":false,"sub_message":{"message":"A Twitch baby is born! KappaHD","emotes":[{"start":23,"end":7,"id":2867}]}}`,
+			context: ContextResub,
+			resub:   true,
+			check: func(t *testing.T, e *SubscribeEvent) {
+				if e.SubMessage.Message != "A Twitch baby is born! KappaHD" {
+					t.Errorf("sub message = %q", e.SubMessage.Message)
+				}
+				emotes := e.SubMessage.Emotes
+				if len(emotes) != 1 || emotes[0].Start != 23 || emotes[0].End != 7 || emotes[0].ID != 2867 {
+					t.Errorf("emotes = %+v", emotes)
+				}
+			},
+		},
+		{
+			name:    "gift",
+			message: `{"user_name":"tww2","display_name":"TWW2","channel_name":"mr_woodchuck","user_id":"13405587","channel_id":"89614178","time":"2015-12-19T16:39:57-08:00","sub_plan":"1000","sub_plan_name":"Channel Subscription (mr_woodchuck)","months":9,"context":"subgift","is_gift":true,"sub_message":{"message":"","emotes":null},"recipient_id":"19571752","recipient_user_name":"forstycup","recipient_display_name":"forstycup"}`,
+			context: ContextSubGift,
+			gift:    true,
+			check: func(t *testing.T, e *SubscribeEvent) {
+				if e.UserName != "tww2" || e.UserID != "13405587" {
+					t.Errorf("gifter = %s/%s, want tww2/13405587", e.UserName, e.UserID)
+				}
+				if e.RecipientID != "19571752" || e.RecipientUserName != "forstycup" || e.RecipientDisplayName != "forstycup" {
+					t.Errorf("recipient = %s/%s/%s", e.RecipientID, e.RecipientUserName, e.RecipientDisplayName)
+				}
+				if e.Months != 9 || e.MultiMonthDuration != 0 {
+					t.Errorf("months = %d, duration = %d", e.Months, e.MultiMonthDuration)
+				}
+			},
+		},
+		{
+			name:    "multi-month gift",
+			message: `{"benefit_end_month":11,"user_name":"tww2","display_name":"TWW2","channel_name":"mr_woodchuck","user_id":"13405587","channel_id":"89614178","time":"2015-12-19T16:39:57-08:00","sub_message":{"message":"","emotes":null},"sub_plan":"1000","sub_plan_name":"Channel Subscription (mr_woodchuck)","months":9,"context":"subgift","is_gift":true,"recipient_id":"19571752","recipient_user_name":"forstycup","recipient_display_name":"forstycup","multi_month_duration":6}`,
+			context: ContextSubGift,
+			gift:    true,
+			multi:   true,
+			check: func(t *testing.T, e *SubscribeEvent) {
+				if e.MultiMonthDuration != 6 {
+					t.Errorf("duration = %d, want 6", e.MultiMonthDuration)
+				}
+				if e.UserName != "tww2" || e.RecipientUserName != "forstycup" {
+					t.Errorf("gift from %s to %s", e.UserName, e.RecipientUserName)
+				}
+			},
+		},
+		{
+			name:    "anonymous gift",
+			message: `{"channel_name":"mr_woodchuck","channel_id":"89614178","time":"2015-12-19T16:39:57-08:00","sub_plan":"1000","sub_plan_name":"Channel Subscription (mr_woodchuck)","months":9,"context":"anonsubgift","is_gift":true,"sub_message":{"message":"","emotes":null},"recipient_id":"19571752","recipient_user_name":"forstycup","recipient_display_name":"forstycup","multi_month_duration":6}`,
+			context: ContextAnonSubGift,
+			gift:    true,
+			anon:    true,
+			multi:   true,
+			check: func(t *testing.T, e *SubscribeEvent) {
+				if e.UserName != "" || e.DisplayName != "" || e.UserID != "" {
+					t.Errorf("gifter = %s/%s/%s, want none", e.UserName, e.DisplayName, e.UserID)
+				}
+				if e.RecipientID != "19571752" || e.RecipientUserName != "forstycup" {
+					t.Errorf("recipient = %s/%s", e.RecipientID, e.RecipientUserName)
+				}
+				if e.ChannelID != "89614178" {
+					t.Errorf("channel id = %s", e.ChannelID)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := MessageData{Topic: "channel-subscribe-events-v1.89614178", Message: test.message}
+			event, err := DecodeSubscription(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.MessageType() != test.context {
+				t.Errorf("message type = %q, want %q", event.MessageType(), test.context)
+			}
+			if peeked := PeekMessageType(data); peeked != test.context {
+				t.Errorf("peeked message type = %q, want %q", peeked, test.context)
+			}
+			if event.Gift() != test.gift {
+				t.Errorf("gift = %v, want %v", event.Gift(), test.gift)
+			}
+			if event.AnonymousGift() != test.anon {
+				t.Errorf("anonymous gift = %v, want %v", event.AnonymousGift(), test.anon)
+			}
+			if event.Resub() != test.resub {
+				t.Errorf("resub = %v, want %v", event.Resub(), test.resub)
+			}
+			if event.MultiMonth() != test.multi {
+				t.Errorf("multi-month = %v, want %v", event.MultiMonth(), test.multi)
+			}
+			test.check(t, event)
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	data := MessageData{Topic: "channel-bits-events-v2.1", Message: `{"data":`}
+	if _, err := DecodeBits(data); err == nil {
+		t.Error("DecodeBits accepted a truncated message")
+	}
+	if _, err := DecodeBitsBadgeUnlock(data); err == nil {
+		t.Error("DecodeBitsBadgeUnlock accepted a truncated message")
+	}
+	if _, err := DecodeSubscription(data); err == nil {
+		t.Error("DecodeSubscription accepted a truncated message")
+	}
+}
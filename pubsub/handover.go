@@ -0,0 +1,184 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Limits for moving to a new socket after a RECONNECT message
+const (
+	handoverTimeout  = time.Second * 10
+	overlapGrace     = time.Second * 5
+	overlapCacheSize = 1000
+)
+
+// errHandoverTimeout is when the new socket did not acknowledge every topic in time
+var errHandoverTimeout = errors.New("handover timed out")
+
+// handover moves to a new socket after the server asked us to reconnect. The new socket
+// listens to every topic and only takes over delivery once all of them are acknowledged,
+// so nothing is missed in between. The old socket keeps delivering what it already received
+// for a while, and frames both sockets deliver are only handled once.
+func (c *Conn) handover() {
+	c.handoverMutex.Lock()
+	if c.handingOver {
+		c.handoverMutex.Unlock()
+		return
+	}
+	c.handingOver = true
+	c.overlapUntil = time.Now().Add(handoverTimeout + overlapGrace)
+	c.handoverMutex.Unlock()
+
+	start := time.Now()
+	old, err := c.switchSocket()
+
+	// frames are compared while the old socket drains and for a while after
+	c.handoverMutex.Lock()
+	c.handingOver = false
+	c.overlapUntil = time.Now().Add(overlapGrace * 2)
+	c.handoverMutex.Unlock()
+
+	if errors.Is(err, ErrClosed) {
+		return
+	}
+	if err != nil {
+		c.OnError(fmt.Errorf("handover: %w", err), nil)
+
+		// fall back to tearing the old socket down, the gap is measured once connected again
+		c.statsMutex.Lock()
+		c.stats.FailedHandovers++
+		c.stats.LastHandover = time.Since(start)
+		c.disconnectedAt = time.Now()
+		c.statsMutex.Unlock()
+
+		c.reconnect(err)
+		return
+	}
+
+	c.statsMutex.Lock()
+	c.stats.Handovers++
+	c.stats.LastHandover = time.Since(start)
+	c.stats.LastHandoverGap = 0
+	c.statsMutex.Unlock()
+
+	c.OnConnect()
+	c.drainSocket(old)
+}
+
+// drainSocket keeps handling what the old socket still delivers until the overlap grace period
+// is over or the server closes it, then closes it
+func (c *Conn) drainSocket(ws *BasicWebsocket) {
+	timer := time.NewTimer(overlapGrace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ws.disconnected():
+	case <-c.closed:
+	}
+	c.closeSocket(ws)
+}
+
+// switchSocket dials the new socket, listens to every topic on it and then swaps it in.
+// Returns the old socket, which is drained and closed by the caller
+func (c *Conn) switchSocket() (*BasicWebsocket, error) {
+	next := c.newSocket()
+	next.OnConnect = func() {}
+
+	err := next.Connect()
+	if err != nil {
+		c.closeSocket(next)
+		return nil, err
+	}
+
+	err = c.listenAndWait(next)
+	if err != nil {
+		c.closeSocket(next)
+		return nil, err
+	}
+
+	next.OnConnect = c.connectHandler
+
+	// Close takes the socket in use after marking us closing, so we may only swap before that
+	c.wsMutex.Lock()
+	if c.isClosing() {
+		c.wsMutex.Unlock()
+		c.closeSocket(next)
+		return nil, ErrClosed
+	}
+	old := c.ws
+	c.ws = next
+	c.wsMutex.Unlock()
+
+	// the old socket must not come back once the server closes it
+	old.setAutoReconnect(false)
+
+	c.restartPing()
+	return old, nil
+}
+
+// closeSocket closes a socket that is not in use and waits for its goroutines
+func (c *Conn) closeSocket(ws *BasicWebsocket) {
+	c.dropBatches(ws)
+
+	ctx, cancel := context.WithTimeout(context.Background(), handoverTimeout)
+	defer cancel()
+	_ = ws.Close(ctx)
+}
+
+// listenAndWait sends LISTEN for every topic on the socket and waits for all the responses.
+// Topics Twitch rejects are removed as usual and do not fail the handover.
+func (c *Conn) listenAndWait(ws *BasicWebsocket) error {
+	var responses []chan error
+	defer func() {
+		for _, response := range responses {
+			c.pending.remove(response)
+		}
+	}()
+
+	c.topicsMutex.RLock()
+	topics := make([]*Topic, 0, len(c.topics))
+	for _, topic := range c.topics {
+		topics = append(topics, topic)
+		responses = append(responses, c.pending.add(topic.Nonce))
+	}
+	c.topicsMutex.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), handoverTimeout)
+	defer cancel()
+
+	_, err := c.listenBatched(ctx, ws, topics)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errHandoverTimeout
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, response := range responses {
+		select {
+		case <-response:
+		case <-ctx.Done():
+			return errHandoverTimeout
+		case <-c.closed:
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// duplicateFrame reports whether the frame was already handled from the other socket during a handover
+func (c *Conn) duplicateFrame(data []byte) bool {
+	c.handoverMutex.Lock()
+	overlapping := time.Now().Before(c.overlapUntil)
+	c.handoverMutex.Unlock()
+
+	if !overlapping {
+		return false
+	}
+
+	sum := sha256.Sum256(data)
+	return c.overlapFrames.seen(string(sum[:]))
+}
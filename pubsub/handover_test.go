@@ -0,0 +1,91 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// waitFor polls until the condition holds, failing the test after the timeout
+func waitFor(t *testing.T, timeout time.Duration, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHandoverDeliversFramesFromOldSocket(t *testing.T) {
+	const topic = "channel-points-channel-v1.1"
+	const count = 30
+
+	fs := newFakeServer(t)
+	fs.onRequest = func(fc *fakeClient, request testRequest) {
+		if request.Type != "LISTEN" || fc != fs.client(1) {
+			return
+		}
+		// the new socket is listening, the old one still has frames on the way
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			old := fs.client(0)
+			for i := 0; i < count; i++ {
+				old.sendMessage(topic, fmt.Sprint(i))
+			}
+			// the new socket delivers the second half as well
+			for i := count / 2; i < count; i++ {
+				fc.sendMessage(topic, fmt.Sprint(i))
+			}
+		}()
+	}
+
+	conn := NewConnWithOptions("token", nil, WithURL(fs.url()))
+	received := make(chan string, count*2)
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	_, err := conn.ListenContext(context.Background(), topic, func(data MessageData) {
+		received <- data.Message
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.client(0).write(BaseMessage{Type: "RECONNECT"})
+
+	seen := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for len(seen) < count {
+		select {
+		case message := <-received:
+			seen[message]++
+		case <-timeout:
+			t.Fatalf("received %d of %d messages", len(seen), count)
+		}
+	}
+
+	// nothing delivered twice
+	time.Sleep(100 * time.Millisecond)
+	for len(received) > 0 {
+		seen[<-received]++
+	}
+	for message, n := range seen {
+		if n != 1 {
+			t.Errorf("message %s delivered %d times", message, n)
+		}
+	}
+
+	if stats := conn.Stats(); stats.Handovers != 1 {
+		t.Errorf("handovers = %d, want 1", stats.Handovers)
+	}
+}
@@ -0,0 +1,152 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// connections used by the pool benchmarks, each filled with maxTopics topics
+var benchConnections = []int{1, 4, 10}
+
+// newBenchPool creates a pool that is not started, with full connections
+func newBenchPool(b *testing.B, connections int) (*Pool, []string) {
+	b.Helper()
+
+	pool := NewPoolWithOptions("token", nil, WithURL("ws://127.0.0.1:0"))
+	pool.MaxConnections = connections
+
+	names := make([]string, 0, connections*maxTopics)
+	for i := 0; i < connections*maxTopics; i++ {
+		names = append(names, fmt.Sprintf("channel-points-channel-v1.%d", i))
+	}
+	if _, err := pool.ListenMany(func(MessageData) {}, names...); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = pool.Close(ctx)
+	})
+	return pool, names
+}
+
+// scanTopics is how topics were stored before they were indexed
+type scanTopics struct {
+	conn   *Conn
+	topics []*Topic
+}
+
+func newScanTopics(conn *Conn) *scanTopics {
+	return &scanTopics{conn: conn, topics: conn.topicsSnapshot()}
+}
+
+// byName is the linear lookup the map index replaced
+func (s *scanTopics) byName(name string) *Topic {
+	s.conn.topicsMutex.RLock()
+	defer s.conn.topicsMutex.RUnlock()
+
+	for _, topic := range s.topics {
+		if topic.Name == name {
+			return topic
+		}
+	}
+	return nil
+}
+
+// byNonce is the linear lookup the map index replaced
+func (s *scanTopics) byNonce(nonce string) *Topic {
+	s.conn.topicsMutex.RLock()
+	defer s.conn.topicsMutex.RUnlock()
+
+	for _, topic := range s.topics {
+		if topic.Nonce == nonce {
+			return topic
+		}
+	}
+	return nil
+}
+
+func BenchmarkConnGetTopicByName(b *testing.B) {
+	pool, names := newBenchPool(b, 1)
+	conn := pool.connections[0]
+
+	b.Run("map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if conn.getTopicByName(names[i%len(names)]) == nil {
+				b.Fatal("topic not found")
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		scan := newScanTopics(conn)
+		for i := 0; i < b.N; i++ {
+			if scan.byName(names[i%len(names)]) == nil {
+				b.Fatal("topic not found")
+			}
+		}
+	})
+}
+
+func BenchmarkConnGetTopicByNonce(b *testing.B) {
+	pool, _ := newBenchPool(b, 1)
+	conn := pool.connections[0]
+
+	var nonces []string
+	for _, topic := range conn.topicsSnapshot() {
+		nonces = append(nonces, topic.Nonce)
+	}
+
+	b.Run("map", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if conn.getTopicByNonce(nonces[i%len(nonces)]) == nil {
+				b.Fatal("topic not found")
+			}
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		scan := newScanTopics(conn)
+		for i := 0; i < b.N; i++ {
+			if scan.byNonce(nonces[i%len(nonces)]) == nil {
+				b.Fatal("topic not found")
+			}
+		}
+	})
+}
+
+func BenchmarkPoolGetTopicByName(b *testing.B) {
+	for _, connections := range benchConnections {
+		pool, names := newBenchPool(b, connections)
+
+		b.Run(fmt.Sprintf("map/%dconns", connections), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if topic, _ := pool.getTopicByName(names[i%len(names)]); topic == nil {
+					b.Fatal("topic not found")
+				}
+			}
+		})
+
+		b.Run(fmt.Sprintf("scan/%dconns", connections), func(b *testing.B) {
+			var scans []*scanTopics
+			for _, conn := range pool.connections {
+				scans = append(scans, newScanTopics(conn))
+			}
+
+			for i := 0; i < b.N; i++ {
+				name := names[i%len(names)]
+				var found *Topic
+				pool.connectionsMutex.RLock()
+				for _, scan := range scans {
+					if found = scan.byName(name); found != nil {
+						break
+					}
+				}
+				pool.connectionsMutex.RUnlock()
+				if found == nil {
+					b.Fatal("topic not found")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package pubsub
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a TopicCallback, for example to filter, log or time messages
+type Middleware func(TopicCallback) TopicCallback
+
+// PanicInfo is the OnError info for ErrCallbackPanic
+type PanicInfo struct {
+	Data  MessageData
+	Value interface{}
+	Stack []byte
+}
+
+// chain wraps the callback so that the first middleware runs first
+func chain(callback TopicCallback, middleware []Middleware) TopicCallback {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		callback = middleware[i](callback)
+	}
+	return callback
+}
+
+// Recover stops a panicking callback from taking down the process and reports it instead
+func Recover(report func(err error, info interface{})) Middleware {
+	return func(next TopicCallback) TopicCallback {
+		return func(data MessageData) {
+			defer func() {
+				if r := recover(); r != nil {
+					info := &PanicInfo{
+						Data:  data,
+						Value: r,
+						Stack: debug.Stack(),
+					}
+					report(fmt.Errorf("topic %q: %w: %v", data.Topic, ErrCallbackPanic, r), info)
+				}
+			}()
+			next(data)
+		}
+	}
+}
+
+// Logger logs every message before it is handed to the callback
+func Logger(logger *log.Logger) Middleware {
+	return func(next TopicCallback) TopicCallback {
+		return func(data MessageData) {
+			logger.Printf("pubsub: message on %s (%d bytes)", data.Topic, len(data.Message))
+			next(data)
+		}
+	}
+}
+
+// Timing reports how long the callback took for every message
+func Timing(observe func(topic string, elapsed time.Duration)) Middleware {
+	return func(next TopicCallback) TopicCallback {
+		return func(data MessageData) {
+			start := time.Now()
+			defer func() {
+				observe(data.Topic, time.Since(start))
+			}()
+			next(data)
+		}
+	}
+}
+
+// Filter only passes on messages for which allow returns true
+func Filter(allow func(MessageData) bool) Middleware {
+	return func(next TopicCallback) TopicCallback {
+		return func(data MessageData) {
+			if allow(data) {
+				next(data)
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Moderation message types
+const (
+	TypeModerationAction     = "moderation_action"
+	TypeModeratorAdded       = "moderator_added"
+	TypeModeratorRemoved     = "moderator_removed"
+	TypeChannelTermsAction   = "channel_terms_action"
+	TypeWhisperReceived      = "whisper_received"
+	TypeWhisperSent          = "whisper_sent"
+	TypeAutoModCaughtMessage = "automod_caught_message"
+)
+
+// Values of ModerationActionData.ModerationAction
+const (
+	ModActionBan       = "ban"
+	ModActionUnban     = "unban"
+	ModActionTimeout   = "timeout"
+	ModActionUntimeout = "untimeout"
+	ModActionDelete    = "delete"
+)
+
+// Values of TermActionData.Type
+const (
+	TermAddBlocked      = "add_blocked_term"
+	TermAddPermitted    = "add_permitted_term"
+	TermDeleteBlocked   = "delete_blocked_term"
+	TermDeletePermitted = "delete_permitted_term"
+)
+
+// ModerationActionData describes a moderator acting on a user
+type ModerationActionData struct {
+	Type             string   `json:"type"`
+	ModerationAction string   `json:"moderation_action"`
+	Args             []string `json:"args"`
+	CreatedBy        string   `json:"created_by"`
+	CreatedByUserID  string   `json:"created_by_user_id"`
+	MsgID            string   `json:"msg_id"`
+	TargetUserID     string   `json:"target_user_id"`
+	TargetUserLogin  string   `json:"target_user_login"`
+	ChannelID        string   `json:"channel_id"`
+	FromAutoMod      bool     `json:"from_automod"`
+}
+
+// ModerationAction is from chat_moderator_actions, e.g. a ban, timeout or unban
+type ModerationAction struct {
+	Type string
+	Data ModerationActionData
+}
+
+// MessageType implements Event
+func (e *ModerationAction) MessageType() string { return e.Type }
+
+// IsBan reports whether a user was banned
+func (e *ModerationAction) IsBan() bool { return e.Data.ModerationAction == ModActionBan }
+
+// IsUnban reports whether a user was unbanned
+func (e *ModerationAction) IsUnban() bool { return e.Data.ModerationAction == ModActionUnban }
+
+// IsTimeout reports whether a user was timed out
+func (e *ModerationAction) IsTimeout() bool { return e.Data.ModerationAction == ModActionTimeout }
+
+// TimeoutDuration returns the length of a timeout, which Twitch sends as the second argument
+func (e *ModerationAction) TimeoutDuration() (time.Duration, bool) {
+	if !e.IsTimeout() || len(e.Data.Args) < 2 {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(e.Data.Args[1])
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// TermActionData describes a change to the blocked or permitted terms of a channel
+type TermActionData struct {
+	Type           string     `json:"type"`
+	ID             string     `json:"id"`
+	Text           string     `json:"text"`
+	RequesterID    string     `json:"requester_id"`
+	RequesterLogin string     `json:"requester_login"`
+	ChannelID      string     `json:"channel_id"`
+	ExpiresAt      *time.Time `json:"expires_at"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+	FromAutoMod    bool       `json:"from_automod"`
+}
+
+// UnmarshalJSON accepts the empty expires_at Twitch sends for terms that do not expire
+func (d *TermActionData) UnmarshalJSON(data []byte) error {
+	type termActionData TermActionData
+	fields := struct {
+		*termActionData
+		ExpiresAt string `json:"expires_at"`
+	}{termActionData: (*termActionData)(d)}
+
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+
+	d.ExpiresAt = nil
+	if fields.ExpiresAt != "" {
+		expiresAt, err := time.Parse(time.RFC3339Nano, fields.ExpiresAt)
+		if err != nil {
+			return err
+		}
+		d.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+// TermAction is from chat_moderator_actions when a term is added or removed
+type TermAction struct {
+	Type string
+	Data TermActionData
+}
+
+// MessageType implements Event
+func (e *TermAction) MessageType() string { return e.Type }
+
+// DecodeModeratorAction decodes a chat_moderator_actions message into a *ModerationAction or *TermAction
+func DecodeModeratorAction(data MessageData) (Event, error) {
+	raw, err := decodeRawEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var event Event
+	var target interface{}
+	switch raw.Type {
+	case TypeModerationAction, TypeModeratorAdded, TypeModeratorRemoved:
+		action := &ModerationAction{Type: raw.Type}
+		event, target = action, &action.Data
+	case TypeChannelTermsAction:
+		action := &TermAction{Type: raw.Type}
+		event, target = action, &action.Data
+	default:
+		return nil, fmt.Errorf("decode message on %s: %q: %w", data.Topic, raw.Type, ErrUnknownMessageType)
+	}
+
+	err = raw.decodeData(target)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s message on %s: %w", raw.Type, data.Topic, err)
+	}
+	return event, nil
+}
+
+// WhisperBadge is a chat badge shown next to a whisper
+type WhisperBadge struct {
+	ID      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// WhisperData is a single whisper
+type WhisperData struct {
+	MessageID string `json:"message_id"`
+	ID        int    `json:"id"`
+	ThreadID  string `json:"thread_id"`
+	Body      string `json:"body"`
+	SentTS    int64  `json:"sent_ts"`
+	FromID    int    `json:"from_id"`
+	Tags      struct {
+		Login       string `json:"login"`
+		DisplayName string `json:"display_name"`
+		Color       string `json:"color"`
+		Emotes      []struct {
+			EmoteID string `json:"emote_id"`
+			Start   int    `json:"start"`
+			End     int    `json:"end"`
+		} `json:"emotes"`
+		Badges []WhisperBadge `json:"badges"`
+	} `json:"tags"`
+	Recipient struct {
+		ID          int            `json:"id"`
+		Username    string         `json:"username"`
+		DisplayName string         `json:"display_name"`
+		Color       string         `json:"color"`
+		Badges      []WhisperBadge `json:"badges"`
+	} `json:"recipient"`
+	Nonce string `json:"nonce"`
+}
+
+// SentAt returns when the whisper was sent
+func (d WhisperData) SentAt() time.Time {
+	return time.Unix(d.SentTS, 0)
+}
+
+// Whisper is from whispers, a whisper sent or received by the user
+type Whisper struct {
+	Type string
+	Data WhisperData
+}
+
+// MessageType implements Event
+func (e *Whisper) MessageType() string { return e.Type }
+
+// DecodeWhisper decodes a whisper_received or whisper_sent message from whispers
+func DecodeWhisper(data MessageData) (*Whisper, error) {
+	raw, err := decodeRawEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw.Type != TypeWhisperReceived && raw.Type != TypeWhisperSent {
+		return nil, fmt.Errorf("decode message on %s: %q: %w", data.Topic, raw.Type, ErrUnknownMessageType)
+	}
+
+	event := &Whisper{Type: raw.Type}
+	err = raw.decodeData(&event.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s message on %s: %w", raw.Type, data.Topic, err)
+	}
+	return event, nil
+}
+
+// AutoModCaughtMessageData is a chat message held back by AutoMod
+type AutoModCaughtMessageData struct {
+	ContentClassification struct {
+		Category string `json:"category"`
+		Level    int    `json:"level"`
+	} `json:"content_classification"`
+	Message struct {
+		ID      string `json:"id"`
+		Content struct {
+			Text      string `json:"text"`
+			Fragments []struct {
+				Text    string `json:"text"`
+				AutoMod *struct {
+					Topics map[string]int `json:"topics"`
+				} `json:"automod"`
+			} `json:"fragments"`
+		} `json:"content"`
+		Sender struct {
+			UserID      string `json:"user_id"`
+			Login       string `json:"login"`
+			DisplayName string `json:"display_name"`
+			ChatColor   string `json:"chat_color"`
+		} `json:"sender"`
+		SentAt time.Time `json:"sent_at"`
+	} `json:"message"`
+	ReasonCode    string `json:"reason_code"`
+	ResolverID    string `json:"resolver_id"`
+	ResolverLogin string `json:"resolver_login"`
+	Status        string `json:"status"`
+}
+
+// AutoModCaughtMessage is from automod-queue, when AutoMod holds a message or it is resolved
+type AutoModCaughtMessage struct {
+	Type string
+	Data AutoModCaughtMessageData
+}
+
+// MessageType implements Event
+func (e *AutoModCaughtMessage) MessageType() string { return e.Type }
+
+// DecodeAutoModQueue decodes an automod_caught_message message from automod-queue
+func DecodeAutoModQueue(data MessageData) (*AutoModCaughtMessage, error) {
+	raw, err := decodeRawEvent(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw.Type != TypeAutoModCaughtMessage {
+		return nil, fmt.Errorf("decode message on %s: %q: %w", data.Topic, raw.Type, ErrUnknownMessageType)
+	}
+
+	event := &AutoModCaughtMessage{Type: raw.Type}
+	err = raw.decodeData(&event.Data)
+	if err != nil {
+		return nil, fmt.Errorf("decode %s message on %s: %w", raw.Type, data.Topic, err)
+	}
+	return event, nil
+}
@@ -0,0 +1,235 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDecodeModeratorAction(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		check   func(t *testing.T, e Event)
+	}{
+		{
+			name:    "ban",
+			message: `{"type":"moderation_action","data":{"type":"chat_login_moderation","moderation_action":"ban","args":["baduser","spamming"],"created_by":"modname","created_by_user_id":"12345","msg_id":"","target_user_id":"67890","target_user_login":"","from_automod":false}}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*ModerationAction)
+				if !action.IsBan() || action.IsTimeout() || action.IsUnban() {
+					t.Errorf("action = %q, want ban", action.Data.ModerationAction)
+				}
+				if len(action.Data.Args) != 2 || action.Data.Args[0] != "baduser" || action.Data.Args[1] != "spamming" {
+					t.Errorf("args = %v", action.Data.Args)
+				}
+				if action.Data.CreatedBy != "modname" || action.Data.CreatedByUserID != "12345" {
+					t.Errorf("created by = %s/%s", action.Data.CreatedBy, action.Data.CreatedByUserID)
+				}
+				if action.Data.TargetUserID != "67890" {
+					t.Errorf("target = %s", action.Data.TargetUserID)
+				}
+				if _, ok := action.TimeoutDuration(); ok {
+					t.Error("ban reported a timeout duration")
+				}
+			},
+		},
+		{
+			name:    "timeout",
+			message: `{"type":"moderation_action","data":{"type":"chat_login_moderation","moderation_action":"timeout","args":["baduser","600","calm down"],"created_by":"modname","created_by_user_id":"12345","msg_id":"","target_user_id":"67890","target_user_login":"","from_automod":false}}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*ModerationAction)
+				if !action.IsTimeout() || action.IsBan() {
+					t.Errorf("action = %q, want timeout", action.Data.ModerationAction)
+				}
+				if d, ok := action.TimeoutDuration(); !ok || d != 10*time.Minute {
+					t.Errorf("timeout = %v, %v, want 10m", d, ok)
+				}
+			},
+		},
+		{
+			name:    "unban with data as a JSON string",
+			message: `{"type":"moderation_action","data":"{\"type\":\"chat_login_moderation\",\"moderation_action\":\"unban\",\"args\":[\"baduser\"],\"created_by\":\"modname\",\"created_by_user_id\":\"12345\",\"msg_id\":\"\",\"target_user_id\":\"67890\",\"target_user_login\":\"\",\"from_automod\":false}"}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*ModerationAction)
+				if !action.IsUnban() {
+					t.Errorf("action = %q, want unban", action.Data.ModerationAction)
+				}
+				if len(action.Data.Args) != 1 || action.Data.Args[0] != "baduser" || action.Data.TargetUserID != "67890" {
+					t.Errorf("args = %v, target = %s", action.Data.Args, action.Data.TargetUserID)
+				}
+			},
+		},
+		{
+			name:    "moderator added as data_object",
+			message: `{"type":"moderator_added","data":"","data_object":{"channel_id":"54321","target_user_id":"67890","moderation_action":"mod","target_user_login":"newmod","created_by_user_id":"12345","created_by":"owner"}}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*ModerationAction)
+				if action.Type != TypeModeratorAdded || action.Data.ModerationAction != "mod" {
+					t.Errorf("type = %s, action = %s", action.Type, action.Data.ModerationAction)
+				}
+				if action.Data.TargetUserLogin != "newmod" || action.Data.ChannelID != "54321" {
+					t.Errorf("target = %s on %s", action.Data.TargetUserLogin, action.Data.ChannelID)
+				}
+			},
+		},
+		{
+			name:    "blocked term added",
+			message: `{"type":"channel_terms_action","data":{"type":"add_blocked_term","id":"6c4b3a2e-1f2d-4e5b-9a8c-7d6e5f4a3b2c","text":"badword","requester_id":"12345","requester_login":"modname","channel_id":"54321","expires_at":"","updated_at":"2021-06-16T20:13:48.447Z","from_automod":false}}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*TermAction)
+				if action.Data.Type != TermAddBlocked || action.Data.Text != "badword" {
+					t.Errorf("term action = %s %q", action.Data.Type, action.Data.Text)
+				}
+				if action.Data.RequesterLogin != "modname" || action.Data.ChannelID != "54321" {
+					t.Errorf("requested by %s on %s", action.Data.RequesterLogin, action.Data.ChannelID)
+				}
+				if action.Data.ExpiresAt != nil {
+					t.Errorf("expires at %v, want never", action.Data.ExpiresAt)
+				}
+				if !action.Data.UpdatedAt.Equal(time.Date(2021, 6, 16, 20, 13, 48, 447000000, time.UTC)) {
+					t.Errorf("updated at %v", action.Data.UpdatedAt)
+				}
+			},
+		},
+		{
+			name:    "permitted term removed",
+			message: `{"type":"channel_terms_action","data":{"type":"delete_permitted_term","id":"1a2b","text":"goodword","requester_id":"12345","requester_login":"modname","channel_id":"54321","expires_at":"2021-06-17T20:13:48Z","updated_at":"2021-06-16T20:13:48Z","from_automod":true}}`,
+			check: func(t *testing.T, e Event) {
+				action := e.(*TermAction)
+				if action.Data.Type != TermDeletePermitted || action.Data.Text != "goodword" || !action.Data.FromAutoMod {
+					t.Errorf("term action = %s %q, automod %v", action.Data.Type, action.Data.Text, action.Data.FromAutoMod)
+				}
+				if action.Data.ExpiresAt == nil || !action.Data.ExpiresAt.Equal(time.Date(2021, 6, 17, 20, 13, 48, 0, time.UTC)) {
+					t.Errorf("expires at %v", action.Data.ExpiresAt)
+				}
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := MessageData{Topic: "chat_moderator_actions.12345.54321", Message: test.message}
+			event, err := DecodeModeratorAction(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if peeked := PeekMessageType(data); event.MessageType() != peeked {
+				t.Errorf("message type = %q, peeked %q", event.MessageType(), peeked)
+			}
+			test.check(t, event)
+		})
+	}
+
+	unknown := MessageData{Topic: "chat_moderator_actions.12345.54321", Message: `{"type":"vip_added","data":{}}`}
+	if _, err := DecodeModeratorAction(unknown); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("unknown type = %v, want %v", err, ErrUnknownMessageType)
+	}
+}
+
+func TestDecodeWhisper(t *testing.T) {
+	const whisper = `{"message_id":"d3b4a1e2-5f6c-4a7b-8c9d-0e1f2a3b4c5d","id":42,"thread_id":"12345_67890","body":"hello Kappa","sent_ts":1623874428,"from_id":67890,"tags":{"login":"sender","display_name":"Sender","color":"#FF0000","emotes":[{"emote_id":"25","start":6,"end":10}],"badges":[{"id":"premium","version":"1"}]},"recipient":{"id":12345,"username":"me","display_name":"Me","color":"","badges":[]},"nonce":"abc"}`
+
+	tests := []struct {
+		name    string
+		message string
+		typ     string
+	}{
+		{
+			name:    "data as a JSON string",
+			message: `{"type":"whisper_received","data":` + quoteJSON(t, whisper) + `}`,
+			typ:     TypeWhisperReceived,
+		},
+		{
+			name:    "data_object",
+			message: `{"type":"whisper_sent","data_object":` + whisper + `}`,
+			typ:     TypeWhisperSent,
+		},
+		{
+			name:    "data_object preferred",
+			message: `{"type":"whisper_received","data":"{\"body\":\"stale\"}","data_object":` + whisper + `}`,
+			typ:     TypeWhisperReceived,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			event, err := DecodeWhisper(MessageData{Topic: "whispers.12345", Message: test.message})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event.MessageType() != test.typ {
+				t.Errorf("message type = %q, want %q", event.MessageType(), test.typ)
+			}
+
+			d := event.Data
+			if d.Body != "hello Kappa" || d.ID != 42 || d.ThreadID != "12345_67890" || d.FromID != 67890 {
+				t.Errorf("whisper = %q #%d in %s from %d", d.Body, d.ID, d.ThreadID, d.FromID)
+			}
+			if !d.SentAt().Equal(time.Unix(1623874428, 0)) {
+				t.Errorf("sent at %v", d.SentAt())
+			}
+			if d.Tags.Login != "sender" || len(d.Tags.Emotes) != 1 || d.Tags.Emotes[0].EmoteID != "25" {
+				t.Errorf("tags = %+v", d.Tags)
+			}
+			if len(d.Tags.Badges) != 1 || d.Tags.Badges[0].ID != "premium" {
+				t.Errorf("badges = %+v", d.Tags.Badges)
+			}
+			if d.Recipient.ID != 12345 || d.Recipient.Username != "me" {
+				t.Errorf("recipient = %+v", d.Recipient)
+			}
+		})
+	}
+
+	thread := MessageData{Topic: "whispers.12345", Message: `{"type":"thread","data":"{}"}`}
+	if _, err := DecodeWhisper(thread); !errors.Is(err, ErrUnknownMessageType) {
+		t.Errorf("thread message = %v, want %v", err, ErrUnknownMessageType)
+	}
+}
+
+func TestDecodeAutoModQueue(t *testing.T) {
+	data := MessageData{
+		Topic:   "automod-queue.12345.54321",
+		Message: `{"type":"automod_caught_message","data":{"content_classification":{"category":"aggressive","level":1},"message":{"content":{"text":"you are dumb","fragments":[{"text":"you are "},{"text":"dumb","automod":{"topics":{"bullying":6}}}]},"id":"a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d","sender":{"user_id":"67890","login":"sender","display_name":"Sender","chat_color":"#1E90FF"},"sent_at":"2021-06-16T20:13:48.447445462Z"},"reason_code":"","resolver_id":"","resolver_login":"","status":"PENDING"}}`,
+	}
+	event, err := DecodeAutoModQueue(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if event.MessageType() != TypeAutoModCaughtMessage {
+		t.Errorf("message type = %q", event.MessageType())
+	}
+	d := event.Data
+	if d.ContentClassification.Category != "aggressive" || d.ContentClassification.Level != 1 {
+		t.Errorf("classification = %+v", d.ContentClassification)
+	}
+	if d.Status != "PENDING" || d.ResolverID != "" {
+		t.Errorf("status = %s, resolver = %q", d.Status, d.ResolverID)
+	}
+	message := d.Message
+	if message.ID != "a1b2c3d4-e5f6-4a7b-8c9d-0e1f2a3b4c5d" || message.Content.Text != "you are dumb" {
+		t.Errorf("message %s = %q", message.ID, message.Content.Text)
+	}
+	fragments := message.Content.Fragments
+	if len(fragments) != 2 || fragments[0].AutoMod != nil || fragments[1].AutoMod == nil || fragments[1].AutoMod.Topics["bullying"] != 6 {
+		t.Errorf("fragments = %+v", fragments)
+	}
+	if message.Sender.UserID != "67890" || message.Sender.Login != "sender" || message.Sender.ChatColor != "#1E90FF" {
+		t.Errorf("sender = %+v", message.Sender)
+	}
+	if !message.SentAt.Equal(time.Date(2021, 6, 16, 20, 13, 48, 447445462, time.UTC)) {
+		t.Errorf("sent at %v", message.SentAt)
+	}
+}
+
+// quoteJSON encodes the JSON as a string, the way Twitch double encodes some data fields
+func quoteJSON(t *testing.T, value string) string {
+	t.Helper()
+	quoted, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(quoted)
+}
@@ -0,0 +1,81 @@
+package pubsub
+
+import (
+	"strings"
+	"sync"
+)
+
+// Mux routes messages to handlers by topic prefix and inner message type, much like http.ServeMux.
+// A handler for the message type wins over a handler for the topic prefix, and the longest
+// matching prefix wins over shorter ones.
+type Mux struct {
+	prefixes map[string]TopicCallback
+	types    map[string]TopicCallback
+	notFound TopicCallback
+	mutex    sync.RWMutex
+}
+
+// NewMux creates an empty Mux that ignores every message
+func NewMux() *Mux {
+	return &Mux{
+		prefixes: make(map[string]TopicCallback),
+		types:    make(map[string]TopicCallback),
+		notFound: func(MessageData) {},
+	}
+}
+
+// Handle registers the handler for topics starting with the prefix, e.g. "channel-points-channel-v1"
+func (m *Mux) Handle(prefix string, handler TopicCallback) {
+	m.mutex.Lock()
+	m.prefixes[prefix] = handler
+	m.mutex.Unlock()
+}
+
+// HandleType registers the handler for messages of the inner type, e.g. "reward-redeemed"
+func (m *Mux) HandleType(messageType string, handler TopicCallback) {
+	m.mutex.Lock()
+	m.types[messageType] = handler
+	m.mutex.Unlock()
+}
+
+// HandleNotFound registers the handler for messages nothing else matched
+func (m *Mux) HandleNotFound(handler TopicCallback) {
+	m.mutex.Lock()
+	m.notFound = handler
+	m.mutex.Unlock()
+}
+
+// Handler returns the handler the message would be routed to
+func (m *Mux) Handler(data MessageData) TopicCallback {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	if len(m.types) > 0 {
+		if handler, ok := m.types[PeekMessageType(data)]; ok {
+			return handler
+		}
+	}
+
+	var match TopicCallback
+	matchLength := -1
+	for prefix, handler := range m.prefixes {
+		if len(prefix) > matchLength && topicHasPrefix(data.Topic, prefix) {
+			match, matchLength = handler, len(prefix)
+		}
+	}
+	if match != nil {
+		return match
+	}
+
+	return m.notFound
+}
+
+// ServeMessage routes the message, it can be used as a TopicCallback
+func (m *Mux) ServeMessage(data MessageData) {
+	m.Handler(data)(data)
+}
+
+// topicHasPrefix matches whole dot separated parts, so "whispers.1" does not match "whispers.12"
+func topicHasPrefix(topic, prefix string) bool {
+	return topic == prefix || strings.HasPrefix(topic, strings.TrimSuffix(prefix, ".")+".")
+}
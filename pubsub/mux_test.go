@@ -0,0 +1,113 @@
+package pubsub
+
+import "testing"
+
+func TestMuxRouting(t *testing.T) {
+	var routed string
+	route := func(name string) TopicCallback {
+		return func(MessageData) { routed = name }
+	}
+
+	mux := NewMux()
+	mux.Handle("channel-points-channel-v1", route("points"))
+	mux.Handle("channel-points-channel-v1.12345", route("points 12345"))
+	mux.Handle("whispers", route("whispers"))
+	mux.Handle("chat_moderator_actions.", route("moderator actions"))
+	mux.HandleType("reward-redeemed", route("reward-redeemed"))
+
+	tests := []struct {
+		name    string
+		topic   string
+		message string
+		want    string
+	}{
+		{
+			name:    "type before prefix",
+			topic:   "channel-points-channel-v1.12345",
+			message: `{"type":"reward-redeemed","data":{}}`,
+			want:    "reward-redeemed",
+		},
+		{
+			name:    "type on a topic without a prefix",
+			topic:   "video-playback.12345",
+			message: `{"type":"reward-redeemed","data":{}}`,
+			want:    "reward-redeemed",
+		},
+		{
+			name:    "longest prefix",
+			topic:   "channel-points-channel-v1.12345",
+			message: `{"type":"custom-reward-updated","data":{}}`,
+			want:    "points 12345",
+		},
+		{
+			name:    "shorter prefix for another channel",
+			topic:   "channel-points-channel-v1.67890",
+			message: `{"type":"custom-reward-updated","data":{}}`,
+			want:    "points",
+		},
+		{
+			name:    "prefix stops at a dot",
+			topic:   "channel-points-channel-v1.123456",
+			message: `{"type":"custom-reward-updated","data":{}}`,
+			want:    "points",
+		},
+		{
+			name:    "prefix is the whole topic",
+			topic:   "whispers",
+			message: `{"type":"whisper_received","data":{}}`,
+			want:    "whispers",
+		},
+		{
+			name:    "prefix matches a whole part",
+			topic:   "whispers.12345",
+			message: `{"type":"whisper_received","data":{}}`,
+			want:    "whispers",
+		},
+		{
+			name:    "prefix with a trailing dot",
+			topic:   "chat_moderator_actions.12345.67890",
+			message: `{"type":"moderation_action","data":{}}`,
+			want:    "moderator actions",
+		},
+		{
+			name:    "prefix does not match part of a word",
+			topic:   "whispersX.12345",
+			message: `{"type":"whisper_received","data":{}}`,
+			want:    "",
+		},
+		{
+			name:    "no match",
+			topic:   "channel-bits-events-v2.12345",
+			message: `{"type":"bits_event","data":{}}`,
+			want:    "",
+		},
+		{
+			name:    "no match for a message that is not JSON",
+			topic:   "channel-bits-events-v2.12345",
+			message: `not json`,
+			want:    "",
+		},
+	}
+
+	run := func(t *testing.T, notFound string) {
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				routed = ""
+				mux.ServeMessage(MessageData{Topic: test.topic, Message: test.message})
+
+				want := test.want
+				if want == "" {
+					want = notFound
+				}
+				if routed != want {
+					t.Errorf("routed to %q, want %q", routed, want)
+				}
+			})
+		}
+	}
+
+	// nothing runs for unmatched messages until a NotFound handler is registered
+	t.Run("default not found", func(t *testing.T) { run(t, "") })
+	mux.HandleNotFound(route("not found"))
+	t.Run("not found", func(t *testing.T) { run(t, "not found") })
+}
@@ -0,0 +1,269 @@
+package pubsub
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Option configures a Pool or Conn created with NewPoolWithOptions or NewConnWithOptions
+type Option func(*options)
+
+type options struct {
+	url              string
+	dialer           *websocket.Dialer
+	netDialContext   func(ctx context.Context, network, addr string) (net.Conn, error)
+	proxy            func(*http.Request) (*url.URL, error)
+	tlsConfig        *tls.Config
+	handshakeTimeout time.Duration
+
+	deliveryMode      DeliveryMode
+	deliveryWorkers   int
+	deliveryQueueSize int
+	overflowPolicy    OverflowPolicy
+
+	middleware []Middleware
+
+	chanBuffer int
+
+	tokenSource TokenSource
+
+	dedupeWindow time.Duration
+	dedupeSize   int
+
+	pingInterval time.Duration
+	pongDeadline time.Duration
+
+	writeQueueSize int
+
+	rateLimit float64
+	rateBurst int
+
+	listenBatchSize int
+	relistenJitter  time.Duration
+}
+
+func newOptions(opts []Option) *options {
+	o := &options{
+		url:          twitchPubSubURL,
+		chanBuffer:   defaultChanBuffer,
+		pingInterval: pingInterval,
+		pongDeadline: pongDeadline,
+
+		writeQueueSize: bufferSize,
+
+		listenBatchSize: defaultListenBatchSize,
+		relistenJitter:  defaultRelistenJitter,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// newDialer builds the dialer for a websocket without modifying the one that was passed in
+func (o *options) newDialer() *websocket.Dialer {
+	dialer := *websocket.DefaultDialer
+	if o.dialer != nil {
+		dialer = *o.dialer
+	}
+
+	if o.netDialContext != nil {
+		dialer.NetDialContext = o.netDialContext
+	}
+	if o.proxy != nil {
+		dialer.Proxy = o.proxy
+	}
+	if o.tlsConfig != nil {
+		dialer.TLSClientConfig = o.tlsConfig
+	}
+	if o.handshakeTimeout > 0 {
+		dialer.HandshakeTimeout = o.handshakeTimeout
+	}
+	return &dialer
+}
+
+// WithURL connects to a different PubSub endpoint, such as a local stand-in server
+func WithURL(url string) Option {
+	return func(o *options) {
+		o.url = url
+	}
+}
+
+// WithDialer uses a copy of the dialer instead of websocket.DefaultDialer
+func WithDialer(dialer *websocket.Dialer) Option {
+	return func(o *options) {
+		o.dialer = dialer
+	}
+}
+
+// WithDialFunc sets how the underlying network connection is created
+func WithDialFunc(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.netDialContext = dial
+	}
+}
+
+// WithProxy routes connections through the proxy returned by the function, see http.ProxyURL
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) Option {
+	return func(o *options) {
+		o.proxy = proxy
+	}
+}
+
+// WithTLSConfig sets the TLS configuration used for wss:// endpoints
+func WithTLSConfig(config *tls.Config) Option {
+	return func(o *options) {
+		o.tlsConfig = config
+	}
+}
+
+// WithHandshakeTimeout limits how long the websocket handshake may take
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.handshakeTimeout = timeout
+	}
+}
+
+// WithDeliveryMode sets how messages are handed to topic callbacks, DeliveryOrdered by default
+func WithDeliveryMode(mode DeliveryMode) Option {
+	return func(o *options) {
+		o.deliveryMode = mode
+	}
+}
+
+// WithDeliveryWorkers sets the number of workers per connection for DeliveryWorkerPool
+func WithDeliveryWorkers(workers int) Option {
+	return func(o *options) {
+		o.deliveryWorkers = workers
+	}
+}
+
+// WithDeliveryQueueSize sets how many messages may wait for a callback before the overflow policy applies
+func WithDeliveryQueueSize(size int) Option {
+	return func(o *options) {
+		o.deliveryQueueSize = size
+	}
+}
+
+// WithOverflowPolicy sets what happens when a delivery queue is full, OverflowBlock by default
+func WithOverflowPolicy(policy OverflowPolicy) Option {
+	return func(o *options) {
+		o.overflowPolicy = policy
+	}
+}
+
+// WithMiddleware wraps every topic callback, the first middleware runs first
+func WithMiddleware(middleware ...Middleware) Option {
+	return func(o *options) {
+		o.middleware = append(o.middleware, middleware...)
+	}
+}
+
+// WithChanBuffer sets the buffer size of channels returned by Pool.SubscribeChan
+func WithChanBuffer(size int) Option {
+	return func(o *options) {
+		o.chanBuffer = size
+	}
+}
+
+// WithTokenSource provides the access token instead of the fixed token passed to the constructor.
+// On ERR_BADAUTH the token is refreshed and the affected topics are listened to again.
+func WithTokenSource(tokens TokenSource) Option {
+	return func(o *options) {
+		o.tokenSource = tokens
+	}
+}
+
+// WithDeduplication stops the same event from reaching callbacks twice, for example after
+// a reconnect. Events are remembered for the window, up to size events. Zero values use
+// the defaults of 10 minutes and 10000 events.
+func WithDeduplication(window time.Duration, size int) Option {
+	return func(o *options) {
+		o.dedupeWindow = window
+		o.dedupeSize = size
+		if o.dedupeWindow <= 0 {
+			o.dedupeWindow = defaultDedupeWindow
+		}
+		if o.dedupeSize <= 0 {
+			o.dedupeSize = defaultDedupeSize
+		}
+	}
+}
+
+// newEventCache returns the cache for WithDeduplication, or nil when it is not enabled
+func (o *options) newEventCache() *dedupeCache {
+	if o.dedupeSize <= 0 {
+		return nil
+	}
+	return newDedupeCache(o.dedupeSize, o.dedupeWindow)
+}
+
+// WithPingInterval changes how often a PING is sent, Twitch asks for at least every 5 minutes
+func WithPingInterval(interval time.Duration) Option {
+	return func(o *options) {
+		if interval > 0 {
+			o.pingInterval = interval
+		}
+	}
+}
+
+// WithPongDeadline changes how long to wait for a PONG before reconnecting
+func WithPongDeadline(deadline time.Duration) Option {
+	return func(o *options) {
+		if deadline > 0 {
+			o.pongDeadline = deadline
+		}
+	}
+}
+
+// WithWriteQueueSize sets how many outgoing messages each socket queues before senders wait
+func WithWriteQueueSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.writeQueueSize = size
+		}
+	}
+}
+
+// WithRateLimit limits LISTEN and UNLISTEN messages to perSecond on average, with bursts of up
+// to burst messages. A Pool shares the limit between its connections. Off by default
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(o *options) {
+		o.rateLimit = perSecond
+		o.rateBurst = burst
+	}
+}
+
+// WithListenBatchSize sets how many topics sharing a token go into one LISTEN, 10 by default
+func WithListenBatchSize(size int) Option {
+	return func(o *options) {
+		if size > 0 {
+			o.listenBatchSize = size
+		}
+	}
+}
+
+// WithRelistenJitter sets the longest random delay before topics are listened to again after
+// a reconnect, so connections that lost the server together do not all send their LISTENs at
+// once. 2 seconds by default, 0 listens right away
+func WithRelistenJitter(jitter time.Duration) Option {
+	return func(o *options) {
+		if jitter >= 0 {
+			o.relistenJitter = jitter
+		}
+	}
+}
+
+// newRateLimiter returns the limiter for WithRateLimit, or nil when it is not enabled
+func (o *options) newRateLimiter() *rateLimiter {
+	if o.rateLimit <= 0 {
+		return nil
+	}
+	return newRateLimiter(o.rateLimit, o.rateBurst)
+}
@@ -0,0 +1,68 @@
+package pubsub
+
+import "sync"
+
+// pendingResponses tracks requests waiting for the RESPONSE with a matching nonce
+type pendingResponses struct {
+	waiters map[string][]chan error
+	mutex   sync.Mutex
+}
+
+func newPendingResponses() *pendingResponses {
+	return &pendingResponses{
+		waiters: make(map[string][]chan error),
+	}
+}
+
+// add registers a waiter for the nonce, it must be called before the request is sent
+func (p *pendingResponses) add(nonce string) chan error {
+	ch := make(chan error, 1)
+	p.mutex.Lock()
+	p.waiters[nonce] = append(p.waiters[nonce], ch)
+	p.mutex.Unlock()
+	return ch
+}
+
+// remove unregisters the waiter, wherever it was renamed to
+func (p *pendingResponses) remove(ch chan error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for nonce, waiters := range p.waiters {
+		for i, waiter := range waiters {
+			if waiter != ch {
+				continue
+			}
+			waiters = append(waiters[:i:i], waiters[i+1:]...)
+			if len(waiters) == 0 {
+				delete(p.waiters, nonce)
+			} else {
+				p.waiters[nonce] = waiters
+			}
+			return
+		}
+	}
+}
+
+// rename moves the waiters to the nonce of a request that replaces the original one
+func (p *pendingResponses) rename(oldNonce, newNonce string) {
+	p.mutex.Lock()
+	if waiters, ok := p.waiters[oldNonce]; ok {
+		delete(p.waiters, oldNonce)
+		p.waiters[newNonce] = append(p.waiters[newNonce], waiters...)
+	}
+	p.mutex.Unlock()
+}
+
+// resolve hands the result to every waiter for the nonce. Returns whether anyone was waiting
+func (p *pendingResponses) resolve(nonce string, err error) bool {
+	p.mutex.Lock()
+	waiters, ok := p.waiters[nonce]
+	delete(p.waiters, nonce)
+	p.mutex.Unlock()
+
+	for _, ch := range waiters {
+		ch <- err
+	}
+	return ok
+}
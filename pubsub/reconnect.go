@@ -0,0 +1,72 @@
+package pubsub
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Default values for the reconnect backoff used by Conn
+const (
+	defaultReconnectBase  = time.Second
+	defaultReconnectMax   = time.Minute * 2
+	defaultReconnectReset = time.Minute
+)
+
+// ReconnectPolicy decides how long a websocket waits before each reconnect attempt
+type ReconnectPolicy interface {
+	// NextDelay returns the delay before the given attempt, counting from 1.
+	// Returning false means no further attempts should be made.
+	NextDelay(attempt int) (time.Duration, bool)
+}
+
+// ConstantBackoff waits the same amount of time before every attempt, forever
+type ConstantBackoff time.Duration
+
+// NextDelay implements ReconnectPolicy
+func (b ConstantBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	return time.Duration(b), true
+}
+
+// ExponentialBackoff doubles the delay on every attempt, using full jitter
+type ExponentialBackoff struct {
+	// Delay ceiling for the first attempt
+	Base time.Duration
+	// Upper bound for any single delay, 0 for no bound
+	Max time.Duration
+	// Number of attempts before giving up, 0 for unlimited
+	MaxAttempts int
+}
+
+// NewExponentialBackoff creates the backoff Twitch recommends: 1s doubling up to 2 minutes
+func NewExponentialBackoff() *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Base: defaultReconnectBase,
+		Max:  defaultReconnectMax,
+	}
+}
+
+// NextDelay implements ReconnectPolicy
+func (b *ExponentialBackoff) NextDelay(attempt int) (time.Duration, bool) {
+	if b.MaxAttempts > 0 && attempt > b.MaxAttempts {
+		return 0, false
+	}
+
+	// doubles from Base until it reaches Max, stopping short of overflowing
+	ceiling := b.Base
+	for i := 1; i < attempt && ceiling > 0 && ceiling <= math.MaxInt64/2; i++ {
+		if b.Max > 0 && ceiling >= b.Max {
+			break
+		}
+		ceiling *= 2
+	}
+	if b.Max > 0 && (ceiling > b.Max || ceiling <= 0) {
+		ceiling = b.Max
+	}
+	if ceiling <= 0 {
+		return 0, true
+	}
+
+	// full jitter, anywhere between zero and the ceiling
+	return time.Duration(rand.Int63n(int64(ceiling) + 1)), true
+}
@@ -0,0 +1,94 @@
+package pubsub
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// delayCeiling samples the delays for an attempt, failing if one exceeds the ceiling or none
+// gets near it
+func delayCeiling(t *testing.T, b *ExponentialBackoff, attempt int, ceiling time.Duration) {
+	t.Helper()
+
+	var longest time.Duration
+	for i := 0; i < 200; i++ {
+		delay, ok := b.NextDelay(attempt)
+		if !ok {
+			t.Fatalf("attempt %d: gave up", attempt)
+		}
+		if delay < 0 || delay > ceiling {
+			t.Fatalf("attempt %d: delay %v outside 0 to %v", attempt, delay, ceiling)
+		}
+		if delay > longest {
+			longest = delay
+		}
+	}
+	if longest <= ceiling/2 {
+		t.Errorf("attempt %d: longest delay %v, want up to %v", attempt, longest, ceiling)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		backoff  ExponentialBackoff
+		attempt  int
+		ceiling  time.Duration
+		giveUp   bool
+		constant bool
+	}{
+		{name: "first attempt", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute}, attempt: 1, ceiling: time.Second},
+		{name: "doubles", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute}, attempt: 2, ceiling: 2 * time.Second},
+		{name: "doubles again", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute}, attempt: 5, ceiling: 16 * time.Second},
+		{name: "capped", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute}, attempt: 7, ceiling: time.Minute},
+		{name: "capped after many attempts", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute}, attempt: 1000, ceiling: time.Minute},
+		{name: "no max", backoff: ExponentialBackoff{Base: time.Second, MaxAttempts: 20}, attempt: 10, ceiling: 512 * time.Second},
+		{name: "no max after many attempts", backoff: ExponentialBackoff{Base: time.Second}, attempt: 1000, ceiling: math.MaxInt64},
+		{name: "no base", backoff: ExponentialBackoff{Max: time.Minute}, attempt: 3, ceiling: time.Minute},
+		{name: "last attempt", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute, MaxAttempts: 5}, attempt: 5, ceiling: 16 * time.Second},
+		{name: "past max attempts", backoff: ExponentialBackoff{Base: time.Second, Max: time.Minute, MaxAttempts: 5}, attempt: 6, giveUp: true},
+		{name: "nothing set", backoff: ExponentialBackoff{}, attempt: 3, constant: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			switch {
+			case test.giveUp:
+				if _, ok := test.backoff.NextDelay(test.attempt); ok {
+					t.Errorf("attempt %d allowed, want to give up", test.attempt)
+				}
+			case test.constant:
+				if delay, ok := test.backoff.NextDelay(test.attempt); delay != 0 || !ok {
+					t.Errorf("delay = %v, %v, want 0, true", delay, ok)
+				}
+			default:
+				delayCeiling(t, &test.backoff, test.attempt, test.ceiling)
+			}
+		})
+	}
+}
+
+func TestReconnectAttemptsReset(t *testing.T) {
+	ws := NewBasicWebsocket("ws://127.0.0.1:0", nil)
+	ws.ReconnectPolicy = &ExponentialBackoff{Base: time.Second, Max: time.Minute, MaxAttempts: 3}
+	ws.ReconnectResetTime = time.Minute
+
+	for want := 1; want <= 3; want++ {
+		if attempt, _, ok := ws.nextReconnectDelay(); attempt != want || !ok {
+			t.Fatalf("attempt = %d, %v, want %d, true", attempt, ok, want)
+		}
+	}
+
+	// a connection that did not last counts on
+	ws.connectedAt = time.Now()
+	if attempt, _, ok := ws.nextReconnectDelay(); attempt != 4 || ok {
+		t.Errorf("attempt = %d, %v, want 4, false", attempt, ok)
+	}
+
+	// one that stayed up long enough starts over
+	ws.connectedAt = time.Now().Add(-2 * time.Minute)
+	if attempt, delay, ok := ws.nextReconnectDelay(); attempt != 1 || !ok || delay > time.Second {
+		t.Errorf("attempt = %d, %v, %v, want 1, at most 1s, true", attempt, delay, ok)
+	}
+}
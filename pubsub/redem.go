@@ -2,61 +2,171 @@ package pubsub
 
 import "time"
 
+// Channel points message types
+const (
+	TypeRewardRedeemed                   = "reward-redeemed"
+	TypeRedemptionStatusUpdate           = "redemption-status-update"
+	TypeCustomRewardCreated              = "custom-reward-created"
+	TypeCustomRewardUpdated              = "custom-reward-updated"
+	TypeCustomRewardDeleted              = "custom-reward-deleted"
+	TypeUpdateRedemptionStatusesProgress = "update-redemption-statuses-progress"
+)
+
+// RedemptionUser is the user who redeemed a reward
+type RedemptionUser struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+}
+
+// RewardImage is the set of image URLs for a reward
+type RewardImage struct {
+	URL1X string `json:"url_1x"`
+	URL2X string `json:"url_2x"`
+	URL4X string `json:"url_4x"`
+}
+
+// Reward is a custom channel points reward
+type Reward struct {
+	ID                  string       `json:"id"`
+	ChannelID           string       `json:"channel_id"`
+	Title               string       `json:"title"`
+	Prompt              string       `json:"prompt"`
+	Cost                int          `json:"cost"`
+	IsUserInputRequired bool         `json:"is_user_input_required"`
+	IsSubOnly           bool         `json:"is_sub_only"`
+	Image               *RewardImage `json:"image"`
+	DefaultImage        RewardImage  `json:"default_image"`
+	BackgroundColor     string       `json:"background_color"`
+	IsEnabled           bool         `json:"is_enabled"`
+	IsPaused            bool         `json:"is_paused"`
+	IsInStock           bool         `json:"is_in_stock"`
+	MaxPerStream        struct {
+		IsEnabled    bool `json:"is_enabled"`
+		MaxPerStream int  `json:"max_per_stream"`
+	} `json:"max_per_stream"`
+	ShouldRedemptionsSkipRequestQueue bool        `json:"should_redemptions_skip_request_queue"`
+	TemplateID                        interface{} `json:"template_id"`
+	UpdatedForIndicatorAt             time.Time   `json:"updated_for_indicator_at"`
+	MaxPerUserPerStream               struct {
+		IsEnabled           bool `json:"is_enabled"`
+		MaxPerUserPerStream int  `json:"max_per_user_per_stream"`
+	} `json:"max_per_user_per_stream"`
+	GlobalCooldown struct {
+		IsEnabled             bool `json:"is_enabled"`
+		GlobalCooldownSeconds int  `json:"global_cooldown_seconds"`
+	} `json:"global_cooldown"`
+	RedemptionsRedeemedCurrentStream *int       `json:"redemptions_redeemed_current_stream"`
+	CooldownExpiresAt                *time.Time `json:"cooldown_expires_at"`
+}
+
+// Redemption is a single redemption of a reward
+type Redemption struct {
+	ID         string         `json:"id"`
+	User       RedemptionUser `json:"user"`
+	ChannelID  string         `json:"channel_id"`
+	RedeemedAt time.Time      `json:"redeemed_at"`
+	Reward     Reward         `json:"reward"`
+	UserInput  string         `json:"user_input"`
+	Status     string         `json:"status"`
+}
+
+// RedemptionData is the data of messages about a single redemption
+type RedemptionData struct {
+	Timestamp  time.Time  `json:"timestamp"`
+	Redemption Redemption `json:"redemption"`
+}
+
 // RewardRedeemed is the structure when a redemption point is redeemed
 type RewardRedeemed struct {
+	Type string         `json:"type"`
+	Data RedemptionData `json:"data"`
+}
+
+// MessageType implements Event
+func (e *RewardRedeemed) MessageType() string { return e.Type }
+
+// RedemptionStatusUpdate is when a redemption was fulfilled or cancelled
+type RedemptionStatusUpdate struct {
+	Type string         `json:"type"`
+	Data RedemptionData `json:"data"`
+}
+
+// MessageType implements Event
+func (e *RedemptionStatusUpdate) MessageType() string { return e.Type }
+
+// CustomRewardCreated is when a reward was added to the channel
+type CustomRewardCreated struct {
+	Type string `json:"type"`
+	Data struct {
+		Timestamp time.Time `json:"timestamp"`
+		NewReward Reward    `json:"new_reward"`
+	} `json:"data"`
+}
+
+// MessageType implements Event
+func (e *CustomRewardCreated) MessageType() string { return e.Type }
+
+// CustomRewardUpdated is when a reward was changed
+type CustomRewardUpdated struct {
 	Type string `json:"type"`
 	Data struct {
-		Timestamp  time.Time `json:"timestamp"`
-		Redemption struct {
-			ID   string `json:"id"`
-			User struct {
-				ID          string `json:"id"`
-				Login       string `json:"login"`
-				DisplayName string `json:"display_name"`
-			} `json:"user"`
-			ChannelID  string    `json:"channel_id"`
-			RedeemedAt time.Time `json:"redeemed_at"`
-			Reward     struct {
-				ID                  string      `json:"id"`
-				ChannelID           string      `json:"channel_id"`
-				Title               string      `json:"title"`
-				Prompt              string      `json:"prompt"`
-				Cost                int         `json:"cost"`
-				IsUserInputRequired bool        `json:"is_user_input_required"`
-				IsSubOnly           bool        `json:"is_sub_only"`
-				Image               interface{} `json:"image"`
-				DefaultImage        struct {
-					URL1X string `json:"url_1x"`
-					URL2X string `json:"url_2x"`
-					URL4X string `json:"url_4x"`
-				} `json:"default_image"`
-				BackgroundColor string `json:"background_color"`
-				IsEnabled       bool   `json:"is_enabled"`
-				IsPaused        bool   `json:"is_paused"`
-				IsInStock       bool   `json:"is_in_stock"`
-				MaxPerStream    struct {
-					IsEnabled    bool `json:"is_enabled"`
-					MaxPerStream int  `json:"max_per_stream"`
-				} `json:"max_per_stream"`
-				ShouldRedemptionsSkipRequestQueue bool        `json:"should_redemptions_skip_request_queue"`
-				TemplateID                        interface{} `json:"template_id"`
-				UpdatedForIndicatorAt             time.Time   `json:"updated_for_indicator_at"`
-				MaxPerUserPerStream               struct {
-					IsEnabled           bool `json:"is_enabled"`
-					MaxPerUserPerStream int  `json:"max_per_user_per_stream"`
-				} `json:"max_per_user_per_stream"`
-				GlobalCooldown struct {
-					IsEnabled             bool `json:"is_enabled"`
-					GlobalCooldownSeconds int  `json:"global_cooldown_seconds"`
-				} `json:"global_cooldown"`
-				RedemptionsRedeemedCurrentStream interface{} `json:"redemptions_redeemed_current_stream"`
-				CooldownExpiresAt                interface{} `json:"cooldown_expires_at"`
-			} `json:"reward"`
-			Status string `json:"status"`
-		} `json:"redemption"`
+		Timestamp     time.Time `json:"timestamp"`
+		UpdatedReward Reward    `json:"updated_reward"`
 	} `json:"data"`
 }
 
+// MessageType implements Event
+func (e *CustomRewardUpdated) MessageType() string { return e.Type }
+
+// CustomRewardDeleted is when a reward was removed from the channel
+type CustomRewardDeleted struct {
+	Type string `json:"type"`
+	Data struct {
+		Timestamp     time.Time `json:"timestamp"`
+		DeletedReward Reward    `json:"deleted_reward"`
+	} `json:"data"`
+}
+
+// MessageType implements Event
+func (e *CustomRewardDeleted) MessageType() string { return e.Type }
+
+// UpdateRedemptionStatusesProgress is the progress of a bulk redemption status update
+type UpdateRedemptionStatusesProgress struct {
+	Type string `json:"type"`
+	Data struct {
+		Timestamp time.Time `json:"timestamp"`
+		Progress  struct {
+			ID        string `json:"id"`
+			ChannelID string `json:"channel_id"`
+			RewardID  string `json:"reward_id"`
+			Method    string `json:"method"`
+			NewStatus string `json:"new_status"`
+			Processed int    `json:"processed"`
+			Total     int    `json:"total"`
+			Status    string `json:"status"`
+		} `json:"progress"`
+	} `json:"data"`
+}
+
+// MessageType implements Event
+func (e *UpdateRedemptionStatusesProgress) MessageType() string { return e.Type }
+
+var channelPointsEvents = map[string]func() Event{
+	TypeRewardRedeemed:                   func() Event { return &RewardRedeemed{} },
+	TypeRedemptionStatusUpdate:           func() Event { return &RedemptionStatusUpdate{} },
+	TypeCustomRewardCreated:              func() Event { return &CustomRewardCreated{} },
+	TypeCustomRewardUpdated:              func() Event { return &CustomRewardUpdated{} },
+	TypeCustomRewardDeleted:              func() Event { return &CustomRewardDeleted{} },
+	TypeUpdateRedemptionStatusesProgress: func() Event { return &UpdateRedemptionStatusesProgress{} },
+}
+
+// DecodeChannelPoints decodes a channel-points-channel-v1 message into one of the
+// channel points event types, based on its inner "type"
+func DecodeChannelPoints(data MessageData) (Event, error) {
+	return decodeEvent(data, channelPointsEvents)
+}
+
 // Constants related to the Twitch Bot
 const (
 	StatusUnMuteMusic = "Turn on the music B)" // Status indicating that OBS needs to mute the music
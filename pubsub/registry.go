@@ -0,0 +1,247 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// topicRegistry records every topic of a Pool and the connection it is placed on. Topics are
+// reserved before they are listened to, so concurrent calls can neither place the same topic
+// twice nor put more topics on a connection than it can take.
+type topicRegistry struct {
+	entries map[string]*placement
+	// Topics placed on, reserved for or moving to each connection
+	slots map[*Conn]int
+	mutex sync.Mutex
+}
+
+// placement is where a topic is listened to
+type placement struct {
+	conn *Conn
+	// nil while reserved
+	topic *Topic
+	// Connection the topic is moving to, where it takes a slot as well
+	next *Conn
+}
+
+func newTopicRegistry() *topicRegistry {
+	return &topicRegistry{
+		entries: make(map[string]*placement),
+		slots:   make(map[*Conn]int),
+	}
+}
+
+// freeLocked returns how many more topics fit on the connection, mutex must be held
+func (r *topicRegistry) freeLocked(conn *Conn) int {
+	free := maxTopics - r.slots[conn]
+	if capacity := conn.Capacity(); capacity < free {
+		free = capacity
+	}
+	return free
+}
+
+// free returns how many more topics fit on the connection
+func (r *topicRegistry) free(conn *Conn) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.freeLocked(conn)
+}
+
+func (r *topicRegistry) reserveLocked(name string, conn *Conn) {
+	r.entries[name] = &placement{conn: conn}
+	r.slots[conn]++
+}
+
+// placeLocked records a reserved topic once it is listened to. Returns false if it was
+// removed again in the meantime, in which case the reservation is dropped
+func (r *topicRegistry) placeLocked(t *Topic) bool {
+	entry := r.entries[t.Name]
+	if entry == nil || entry.topic != nil {
+		return false
+	}
+
+	select {
+	case <-t.Done():
+		r.deleteLocked(t.Name, entry)
+		return false
+	default:
+		entry.topic = t
+		return true
+	}
+}
+
+// cancel drops the reservation for a topic that could not be listened to
+func (r *topicRegistry) cancel(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cancelLocked(name)
+}
+
+func (r *topicRegistry) cancelLocked(name string) {
+	entry := r.entries[name]
+	if entry != nil && entry.topic == nil {
+		r.deleteLocked(name, entry)
+	}
+}
+
+// removeLocked drops the topic once it is no longer listened to
+func (r *topicRegistry) removeLocked(t *Topic) {
+	entry := r.entries[t.Name]
+	if entry != nil && entry.topic == t {
+		r.deleteLocked(t.Name, entry)
+	}
+}
+
+func (r *topicRegistry) deleteLocked(name string, entry *placement) {
+	delete(r.entries, name)
+	r.release(entry.conn)
+	if entry.next != nil {
+		r.release(entry.next)
+	}
+}
+
+func (r *topicRegistry) release(conn *Conn) {
+	r.slots[conn]--
+	if r.slots[conn] <= 0 {
+		delete(r.slots, conn)
+	}
+}
+
+// startMove takes a slot on the connection the topic moves to. Returns false if the
+// connection has no room or the topic is gone
+func (r *topicRegistry) startMove(t *Topic, next *Conn) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.entries[t.Name]
+	if entry == nil || entry.topic != t || entry.next != nil || r.freeLocked(next) < 1 {
+		return false
+	}
+	entry.next = next
+	r.slots[next]++
+	return true
+}
+
+// endMove leaves the topic on the connection it moved to, or frees the slot taken there
+func (r *topicRegistry) endMove(t *Topic, moved bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	entry := r.entries[t.Name]
+	if entry == nil || entry.topic != t || entry.next == nil {
+		return
+	}
+	if moved {
+		r.release(entry.conn)
+		entry.conn = entry.next
+	} else {
+		r.release(entry.next)
+	}
+	entry.next = nil
+}
+
+// reserve places each topic on a connection with room, opening connections as needed.
+// Returns the connection for each topic, nothing is reserved if any of them fails
+func (p *Pool) reserve(names ...string) ([]*Conn, error) {
+	conns, opened, err := p.reserveLocked(names)
+
+	// started outside the lock, as OnConnect may listen to more topics
+	for _, conn := range opened {
+		p.startConnection(conn)
+	}
+	return conns, err
+}
+
+func (p *Pool) reserveLocked(names []string) (conns []*Conn, opened []*Conn, err error) {
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+
+	for _, name := range names {
+		if _, ok := p.registry.entries[name]; ok {
+			err = fmt.Errorf("listen topic %s: %w", name, ErrDuplicateTopic)
+			break
+		}
+
+		conn := p.connectionWithRoomLocked()
+		if conn == nil {
+			conn, err = p.createNewConnection()
+			if err != nil {
+				err = fmt.Errorf("listen topic %s: %w", name, err)
+				break
+			}
+			opened = append(opened, conn)
+		}
+
+		p.registry.reserveLocked(name, conn)
+		conns = append(conns, conn)
+	}
+
+	if err != nil {
+		for _, name := range names[:len(conns)] {
+			p.registry.cancelLocked(name)
+		}
+		return nil, opened, err
+	}
+	return conns, opened, nil
+}
+
+// connectionWithRoomLocked returns the first connection with room that is not being compacted,
+// the registry mutex must be held
+func (p *Pool) connectionWithRoomLocked() *Conn {
+	p.connectionsMutex.RLock()
+	defer p.connectionsMutex.RUnlock()
+
+	for _, conn := range p.connections {
+		if _, draining := p.draining[conn]; !draining && p.registry.freeLocked(conn) > 0 {
+			return conn
+		}
+	}
+	return nil
+}
+
+// startConnection starts a connection opened for a reservation if the pool is running
+func (p *Pool) startConnection(conn *Conn) {
+	p.runningMutex.Lock()
+	defer p.runningMutex.Unlock()
+
+	if !p.running {
+		return
+	}
+	err := conn.Start()
+	if err != nil && !errors.Is(err, ErrAlreadyConnected) {
+		p.OnError(conn, err, nil)
+	}
+}
+
+// settle records the outcome of listening to a reserved topic on the connection.
+// Returns the topic, or nil if the connection did not keep it
+func (p *Pool) settle(conn *Conn, name string) *Topic {
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+
+	t := conn.getTopicByName(name)
+	if t == nil {
+		p.registry.cancelLocked(name)
+		return nil
+	}
+	if p.registry.placeLocked(t) {
+		p.trackTopic(t)
+	}
+	return t
+}
+
+// listenReserved reserves the topic and listens to it on the connection it was placed on
+func (p *Pool) listenReserved(topic string, listen func(conn *Conn) (*Topic, error)) (*Topic, error) {
+	conns, err := p.reserve(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := listen(conns[0])
+	p.settle(conns[0], topic)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,188 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// checkRegistry verifies the registry against the connections, no move may be in progress
+func checkRegistry(t *testing.T, p *Pool) {
+	t.Helper()
+
+	p.registry.mutex.Lock()
+	defer p.registry.mutex.Unlock()
+	p.connectionsMutex.RLock()
+	defer p.connectionsMutex.RUnlock()
+
+	slots := 0
+	for _, n := range p.registry.slots {
+		slots += n
+	}
+	if slots != len(p.registry.entries) {
+		t.Errorf("registry slots = %d, entries = %d", slots, len(p.registry.entries))
+	}
+
+	placed := make(map[string]*Conn)
+	topics := 0
+	for _, conn := range p.connections {
+		for _, topic := range conn.topicsSnapshot() {
+			topics++
+			if other, ok := placed[topic.Name]; ok {
+				t.Errorf("topic %s placed on %p and %p", topic.Name, other, conn)
+			}
+			placed[topic.Name] = conn
+
+			entry := p.registry.entries[topic.Name]
+			if entry == nil || entry.topic != topic || entry.conn != conn {
+				t.Errorf("topic %s is not registered on its connection", topic.Name)
+			}
+		}
+		if n := p.registry.slots[conn]; n != conn.Count() {
+			t.Errorf("connection %p has %d topics, %d slots", conn, conn.Count(), n)
+		}
+	}
+	if topics != len(p.registry.entries) {
+		t.Errorf("connections have %d topics, registry has %d", topics, len(p.registry.entries))
+	}
+	if p.MaxConnections > 0 && len(p.connections) > p.MaxConnections {
+		t.Errorf("%d connections, at most %d allowed", len(p.connections), p.MaxConnections)
+	}
+}
+
+// expectedListenError reports whether err is one a concurrent caller may legitimately get
+func expectedListenError(err error) bool {
+	return err == nil ||
+		errors.Is(err, ErrDuplicateTopic) ||
+		errors.Is(err, ErrInvalidTopic) ||
+		errors.Is(err, ErrTooManyConnections)
+}
+
+func TestPoolRegistryConcurrentListen(t *testing.T) {
+	const names = 120
+
+	fs := newFakeServer(t)
+	pool := NewPoolWithOptions("token", nil, WithURL(fs.url()))
+	pool.MaxConnections = 4
+	pool.OnError = func(conn *Conn, err error, info interface{}) {
+		t.Errorf("pool error: %v", err)
+	}
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	worker := func(f func(i int) error) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := f(i); !expectedListenError(err) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+
+	for g := 0; g < 8; g++ {
+		g := g
+		name := func(i int) string {
+			return fmt.Sprintf("topic.%d", (i*7+g*13)%names)
+		}
+		worker(func(i int) error {
+			_, err := pool.Listen(name(i), nil)
+			return err
+		})
+		worker(func(i int) error {
+			_, err := pool.ListenMany(nil, name(i), name(i+1), name(i+2))
+			return err
+		})
+		worker(func(i int) error {
+			return pool.UnlistenMany(name(i), name(i+3))
+		})
+		worker(func(i int) error {
+			sub, err := pool.Subscribe(name(i), func(MessageData) {})
+			if err != nil {
+				return err
+			}
+			if i%2 == 0 {
+				return sub.Close()
+			}
+			return nil
+		})
+	}
+	worker(func(i int) error {
+		time.Sleep(20 * time.Millisecond)
+		return pool.Compact(context.Background())
+	})
+	worker(func(i int) error {
+		time.Sleep(5 * time.Millisecond)
+		if n := pool.Stats().Connections; n > pool.MaxConnections {
+			t.Errorf("%d connections, at most %d allowed", n, pool.MaxConnections)
+		}
+		return nil
+	})
+
+	time.Sleep(2 * time.Second)
+	close(stop)
+	wg.Wait()
+
+	checkRegistry(t, pool)
+	t.Logf("%+v", pool.Stats())
+
+	pool.registry.mutex.Lock()
+	entries := len(pool.registry.entries)
+	pool.registry.mutex.Unlock()
+	if topics := pool.Stats().Topics; topics != entries {
+		t.Errorf("stats report %d topics, registry has %d", topics, entries)
+	}
+	for i := 0; i < names; i++ {
+		name := fmt.Sprintf("topic.%d", i)
+		_, conn := pool.getTopicByName(name)
+		if pool.IsListening(name) != (conn != nil && conn.IsListening(name)) {
+			t.Errorf("topic %s is not listened to on the connection the pool reports", name)
+		}
+	}
+}
+
+func TestPoolDefaultsAllowManyConnections(t *testing.T) {
+	pool := NewPoolWithOptions("token", nil, WithURL("ws://127.0.0.1:0"))
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := pool.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	// more topics than 10 connections hold
+	names := make([]string, 0, 11*maxTopics)
+	for i := 0; i < 11*maxTopics; i++ {
+		names = append(names, fmt.Sprintf("topic.%d", i))
+	}
+	if _, err := pool.ListenMany(nil, names...); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.Stats().Connections; n != 11 {
+		t.Errorf("%d connections, want 11", n)
+	}
+	if pool.CompactInterval != 0 {
+		t.Errorf("compaction runs every %v by default, want off", pool.CompactInterval)
+	}
+}
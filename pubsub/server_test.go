@@ -0,0 +1,138 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// testRequest is a LISTEN, UNLISTEN or PING received by the fake server
+type testRequest struct {
+	Type  string     `json:"type"`
+	Nonce string     `json:"nonce"`
+	Data  ListenData `json:"data"`
+}
+
+// fakeClient is one websocket connected to the fake server
+type fakeClient struct {
+	conn   *websocket.Conn
+	topics map[string]bool
+	mutex  sync.Mutex
+}
+
+// write sends a frame, errors are ignored as the client may be gone already
+func (fc *fakeClient) write(v interface{}) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	_ = fc.conn.WriteJSON(v)
+}
+
+// sendMessage writes a MESSAGE frame for the topic
+func (fc *fakeClient) sendMessage(topic, message string) {
+	fc.write(MessageMessage{
+		BaseMessage: BaseMessage{Type: "MESSAGE"},
+		Data:        MessageData{Topic: topic, Message: message},
+	})
+}
+
+func (fc *fakeClient) listening(topic string) bool {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.topics[topic]
+}
+
+// fakeServer answers PINGs and acknowledges every LISTEN and UNLISTEN
+type fakeServer struct {
+	server *httptest.Server
+
+	clients []*fakeClient
+	mutex   sync.Mutex
+
+	// Called after a LISTEN or UNLISTEN was acknowledged
+	onRequest func(fc *fakeClient, request testRequest)
+	// Returns the error a LISTEN is answered with, such as ERR_BADAUTH, empty to accept it
+	reject func(request testRequest) string
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	fs := &fakeServer{
+		onRequest: func(fc *fakeClient, request testRequest) {},
+		reject:    func(request testRequest) string { return "" },
+	}
+	upgrader := websocket.Upgrader{}
+	fs.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		fc := &fakeClient{conn: conn, topics: make(map[string]bool)}
+		fs.mutex.Lock()
+		fs.clients = append(fs.clients, fc)
+		fs.mutex.Unlock()
+
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			request := testRequest{}
+			if json.Unmarshal(data, &request) != nil {
+				continue
+			}
+
+			switch request.Type {
+			case "PING":
+				fc.write(BaseMessage{Type: "PONG"})
+			case "LISTEN", "UNLISTEN":
+				code := ""
+				if request.Type == "LISTEN" {
+					code = fs.reject(request)
+				}
+				fc.mutex.Lock()
+				for _, topic := range request.Data.Topics {
+					fc.topics[topic] = code == "" && request.Type == "LISTEN"
+				}
+				fc.mutex.Unlock()
+				fc.write(ResponseMessage{
+					BaseMessage: BaseMessage{Type: "RESPONSE"},
+					Nonce:       request.Nonce,
+					Error:       code,
+				})
+				fs.onRequest(fc, request)
+			}
+		}
+	}))
+	t.Cleanup(fs.server.Close)
+	return fs
+}
+
+func (fs *fakeServer) url() string {
+	return "ws" + strings.TrimPrefix(fs.server.URL, "http")
+}
+
+// broadcast sends the message to every client listening to the topic, as Twitch does
+func (fs *fakeServer) broadcast(topic, message string) {
+	fs.mutex.Lock()
+	clients := append([]*fakeClient(nil), fs.clients...)
+	fs.mutex.Unlock()
+
+	for _, fc := range clients {
+		if fc.listening(topic) {
+			fc.sendMessage(topic, message)
+		}
+	}
+}
+
+func (fs *fakeServer) client(i int) *fakeClient {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	if i >= len(fs.clients) {
+		return nil
+	}
+	return fs.clients[i]
+}
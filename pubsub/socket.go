@@ -1,11 +1,11 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
-	"strings"
 	"sync"
 	"time"
 
@@ -14,32 +14,58 @@ import (
 
 // Constants related to our websocket
 const (
-	bufferSize         = 200
-	closedErrorMessage = "use of closed network connection"
+	bufferSize   = 200
+	closeTimeout = time.Second
 )
 
 // Custom error messages for websocket
 var (
 	// ErrAlreadyConnected is where a client attempted to connect when we are already connected
 	ErrAlreadyConnected = errors.New("already connected")
+
+	// ErrReconnectGaveUp is when the reconnect policy does not allow any further attempts
+	ErrReconnectGaveUp = errors.New("gave up reconnecting")
+
+	// ErrClosed is when the websocket, connection or pool was closed with Close
+	ErrClosed = errors.New("closed")
 )
 
 // BasicWebsocket is something
 type BasicWebsocket struct {
 	conn      *websocket.Conn
 	connected bool
+	// Closed when we close the current connection, so its reader and writer stop
+	closed    chan struct{}
 	connMutex sync.Mutex
 
+	state      State
+	stateMutex sync.Mutex
+
 	url    string
 	header http.Header
 
-	readerMessages chan []byte
-	readerDone     chan bool
-	writerMessages chan []byte
-	writerDone     chan bool
+	reconnectAttempts int
+	connectedAt       time.Time
+	reconnectTimer    *time.Timer
+	closing           bool
+	reconnectMutex    sync.Mutex
+
+	// Closed by Close, so waiting senders give up
+	done chan struct{}
+
+	writerMessages chan frame
+
+	// Reader, writer and scheduled reconnects, waited for by Close
+	wg waitGroup
 
-	// Time in between being disconnected and reconnecting
+	// Dialer used to connect, websocket.DefaultDialer when nil
+	Dialer *websocket.Dialer
+	// Time in between being disconnected and reconnecting, used when ReconnectPolicy is nil
 	ReconnectTime time.Duration
+	// Decides the delay before each reconnect attempt and when to give up
+	ReconnectPolicy ReconnectPolicy
+	// How long a connection must stay up before the reconnect attempts are reset
+	ReconnectResetTime time.Duration
 	// Whether the websocket should try to reconnect after getting disconnected
 	AutoReconnect bool
 	// Callback function to be called on websocket connect/reconnect
@@ -48,10 +74,21 @@ type BasicWebsocket struct {
 	OnMessage func(b []byte) error
 	// Callback function to be called on errors
 	OnError func(err error)
+	// Callback function to be called when the state changes
+	OnStateChange func(from, to State, reason StateReason)
 }
 
 // NewBasicWebsocket creates a new BasicWebsocket with a URL and Header
 func NewBasicWebsocket(url string, header http.Header) *BasicWebsocket {
+	return NewBasicWebsocketWithQueue(url, header, bufferSize)
+}
+
+// NewBasicWebsocketWithQueue creates a new BasicWebsocket that queues up to queueSize outgoing messages
+func NewBasicWebsocketWithQueue(url string, header http.Header, queueSize int) *BasicWebsocket {
+	if queueSize <= 0 {
+		queueSize = bufferSize
+	}
+
 	return &BasicWebsocket{
 		conn:      nil,
 		connected: false,
@@ -59,23 +96,59 @@ func NewBasicWebsocket(url string, header http.Header) *BasicWebsocket {
 		url:    url,
 		header: header,
 
-		readerMessages: make(chan []byte, bufferSize),
-		readerDone:     make(chan bool),
-		writerMessages: make(chan []byte, bufferSize),
-		writerDone:     make(chan bool),
+		state: StateIdle,
+
+		done:           make(chan struct{}),
+		writerMessages: make(chan frame, queueSize),
 
-		ReconnectTime: 0,
-		AutoReconnect: false,
-		OnConnect:     func() {},
-		OnMessage:     func(b []byte) error { return nil },
-		OnError:       func(err error) {},
+		Dialer:             nil,
+		ReconnectTime:      0,
+		ReconnectPolicy:    nil,
+		ReconnectResetTime: defaultReconnectReset,
+		AutoReconnect:      false,
+		OnConnect:          func() {},
+		OnMessage:          func(b []byte) error { return nil },
+		OnError:            func(err error) {},
+		OnStateChange:      func(from, to State, reason StateReason) {},
 	}
 }
 
-func (ws *BasicWebsocket) setConnected(connected bool) {
+// State returns the current state of the websocket
+func (ws *BasicWebsocket) State() State {
+	ws.stateMutex.Lock()
+	defer ws.stateMutex.Unlock()
+	return ws.state
+}
+
+func (ws *BasicWebsocket) setState(state State, reason StateReason) {
+	ws.stateMutex.Lock()
+	old := ws.state
+	ws.state = state
+	ws.stateMutex.Unlock()
+
+	if old != state {
+		ws.OnStateChange(old, state, reason)
+	}
+}
+
+// setAutoReconnect changes AutoReconnect while the websocket is in use
+func (ws *BasicWebsocket) setAutoReconnect(autoReconnect bool) {
+	ws.reconnectMutex.Lock()
+	ws.AutoReconnect = autoReconnect
+	ws.reconnectMutex.Unlock()
+}
+
+// disconnected returns a channel that is closed once the current connection is gone
+func (ws *BasicWebsocket) disconnected() <-chan struct{} {
 	ws.connMutex.Lock()
-	ws.connected = connected
-	ws.connMutex.Unlock()
+	defer ws.connMutex.Unlock()
+
+	if !ws.connected {
+		closed := make(chan struct{})
+		close(closed)
+		return closed
+	}
+	return ws.closed
 }
 
 // IsConnected is something
@@ -87,6 +160,30 @@ func (ws *BasicWebsocket) IsConnected() bool {
 
 // Connect to the server
 func (ws *BasicWebsocket) Connect() error {
+	// a reconnect attempt stays in the reconnecting state until it succeeds or gives up
+	reconnecting := ws.State() == StateReconnecting
+	if !reconnecting && !ws.IsConnected() {
+		ws.setState(StateConnecting, StateReason{})
+	}
+
+	err := ws.connect()
+	if errors.Is(err, ErrAlreadyConnected) {
+		return err
+	}
+	if err != nil {
+		if !reconnecting {
+			ws.setState(StateClosed, StateReason{Err: err})
+		}
+		return err
+	}
+
+	ws.setState(StateConnected, StateReason{})
+	ws.OnConnect()
+
+	return nil
+}
+
+func (ws *BasicWebsocket) connect() error {
 	ws.connMutex.Lock()
 	defer ws.connMutex.Unlock()
 
@@ -94,79 +191,120 @@ func (ws *BasicWebsocket) Connect() error {
 		return ErrAlreadyConnected
 	}
 
-	c, _, err := websocket.DefaultDialer.Dial(ws.url, ws.header)
+	ws.reconnectMutex.Lock()
+	closing := ws.closing
+	ws.reconnectMutex.Unlock()
+	if closing {
+		return ErrClosed
+	}
+
+	dialer := ws.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+
+	c, _, err := dialer.Dial(ws.url, ws.header)
 	if err != nil {
 		return err
 	}
 
 	ws.conn = c
 	ws.connected = true
+	ws.closed = make(chan struct{})
 
-	go ws.startReader()
-	go ws.startWriter()
+	ws.reconnectMutex.Lock()
+	ws.connectedAt = time.Now()
+	ws.reconnectMutex.Unlock()
 
-	ws.OnConnect()
+	ws.wg.Add(2)
+	go ws.startReader(c, ws.closed)
+	go ws.startWriter(c, ws.closed)
 
 	return nil
 }
 
-func (ws *BasicWebsocket) startReader() {
-	unexpectedStop := make(chan bool)
+func (ws *BasicWebsocket) startReader(conn *websocket.Conn, closed chan struct{}) {
+	defer ws.wg.Done()
+
+	messages := make(chan []byte, bufferSize)
+	unexpectedStop := make(chan error, 1)
+
+	// the read loop ends once the connection is closed, so it is done before we are
+	readDone := make(chan struct{})
+	defer func() {
+		<-readDone
+	}()
 
 	go func() {
+		defer close(readDone)
 		for {
-			messageType, message, err := ws.conn.ReadMessage()
+			messageType, message, err := conn.ReadMessage()
 			if err != nil {
-				// conn.Close() was called, so just stop reading
-				// see https://github.com/golang/go/issues/4373
-				if strings.Contains(err.Error(), closedErrorMessage) {
-					return
-				}
-
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure) {
-					// An unexpected error occurred, so notify the reader and reconnect if specified
-					unexpectedStop <- true
+				select {
+				case <-closed:
+					// we closed the connection, so just stop reading
+				default:
+					// the connection dropped, so notify the reader and reconnect if specified
+					unexpectedStop <- err
 				}
 				return
 			}
 
 			if messageType == websocket.TextMessage {
-				ws.readerMessages <- message
+				select {
+				case messages <- message:
+				case <-closed:
+					return
+				}
 			}
 		}
 	}()
 
+	handle := func(message []byte) {
+		err := ws.OnMessage(message)
+		if err != nil {
+			ws.OnError(fmt.Errorf("handle message: %w", err))
+		}
+	}
+
 	for {
 		select {
-		case <-ws.readerDone:
-			return
-		case <-unexpectedStop:
-			ws.Disconnect()
+		case <-closed:
 			return
-		case message := <-ws.readerMessages:
-			err := ws.OnMessage(message)
-			if err != nil {
-				ws.OnError(fmt.Errorf("handle message: %w", err))
+		case err := <-unexpectedStop:
+			// everything read before the error is still handled
+			for len(messages) > 0 {
+				handle(<-messages)
 			}
+			ws.disconnect(conn, closeReason(err))
+			return
+		case message := <-messages:
+			handle(message)
 		}
 	}
 }
 
-func (ws *BasicWebsocket) stopReader() {
-	select {
-	case ws.readerDone <- true:
-	default:
-		return
-	}
+// frame is a message waiting to be written
+type frame struct {
+	data []byte
+	// Set for a flush request instead of a message, closed once everything before it was written
+	flushed chan struct{}
 }
 
-func (ws *BasicWebsocket) startWriter() {
+func (ws *BasicWebsocket) startWriter(conn *websocket.Conn, closed chan struct{}) {
+	defer ws.wg.Done()
+
 	for {
 		select {
-		case <-ws.writerDone:
+		case <-closed:
 			return
-		case message := <-ws.writerMessages:
-			err := ws.conn.WriteMessage(websocket.TextMessage, message)
+		case f := <-ws.writerMessages:
+			if f.flushed != nil {
+				close(f.flushed)
+				continue
+			}
+
+			err := conn.WriteMessage(websocket.TextMessage, f.data)
 			if err != nil {
 				ws.OnError(fmt.Errorf("send message: %w", err))
 			}
@@ -174,34 +312,96 @@ func (ws *BasicWebsocket) startWriter() {
 	}
 }
 
-func (ws *BasicWebsocket) stopWriter() {
-	ws.writerDone <- true
+// closeConn closes the current connection and discards queued messages, connMutex must be held.
+// Returns whether there was a connection to close
+func (ws *BasicWebsocket) closeConn() bool {
+	if !ws.connected {
+		return false
+	}
+
+	ws.connected = false
+	close(ws.closed)
+	_ = ws.conn.Close()
 
 	// empty the channel
-	for len(ws.writerMessages) > 0 {
-		<-ws.writerMessages
+	for {
+		select {
+		case <-ws.writerMessages:
+		default:
+			return true
+		}
 	}
 }
 
 // ForceDisconnect sisconnect without reconnecting
 func (ws *BasicWebsocket) ForceDisconnect() {
 	ws.connMutex.Lock()
-	ws.connected = false
-	_ = ws.conn.Close()
-	ws.stopReader()
-	ws.stopWriter()
+	ws.closeConn()
 	ws.connMutex.Unlock()
+
+	ws.setState(StateClosed, StateReason{})
 }
 
 // Disconnect and, if specified, reconnect afterwards. Returns whether reconnecting
 func (ws *BasicWebsocket) Disconnect() bool {
-	ws.ForceDisconnect()
-	return ws.attemptReconnect()
+	ws.connMutex.Lock()
+	ws.closeConn()
+	ws.connMutex.Unlock()
+
+	return ws.attemptReconnect(StateReason{})
+}
+
+// disconnect after conn failed, unless it was already replaced or closed
+func (ws *BasicWebsocket) disconnect(conn *websocket.Conn, reason StateReason) bool {
+	ws.connMutex.Lock()
+	if ws.conn != conn {
+		ws.connMutex.Unlock()
+		return false
+	}
+	closed := ws.closeConn()
+	ws.connMutex.Unlock()
+
+	if !closed {
+		return false
+	}
+	return ws.attemptReconnect(reason)
 }
 
 // SendBytes send bytes to server (blocking)
 func (ws *BasicWebsocket) SendBytes(bytes []byte) {
-	ws.writerMessages <- bytes
+	_ = ws.SendContext(context.Background(), bytes)
+}
+
+// SendContext queues bytes for the server, waiting for room in the queue until ctx is done
+func (ws *BasicWebsocket) SendContext(ctx context.Context, bytes []byte) error {
+	select {
+	case <-ws.done:
+		return fmt.Errorf("send message: %w", ErrClosed)
+	default:
+	}
+
+	select {
+	case ws.writerMessages <- frame{data: bytes}:
+		return nil
+	case <-ws.done:
+		return fmt.Errorf("send message: %w", ErrClosed)
+	case <-ctx.Done():
+		return fmt.Errorf("send message: %w", ctx.Err())
+	}
+}
+
+// SendJSONContext marshal an interface into JSON, then send bytes to server, see SendContext
+func (ws *BasicWebsocket) SendJSONContext(ctx context.Context, data interface{}) error {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return ws.SendContext(ctx, bytes)
+}
+
+// QueueDepth returns the number of messages waiting to be written
+func (ws *BasicWebsocket) QueueDepth() int {
+	return len(ws.writerMessages)
 }
 
 // SendString send string to server (blocking)
@@ -211,28 +411,87 @@ func (ws *BasicWebsocket) SendString(s string) {
 
 // SendJSON marshal an interface into JSON, then send bytes to server (blocking)
 func (ws *BasicWebsocket) SendJSON(data interface{}) error {
-	bytes, err := json.Marshal(data)
-	if err != nil {
-		return err
+	return ws.SendJSONContext(context.Background(), data)
+}
+
+func (ws *BasicWebsocket) attemptReconnect(reason StateReason) bool {
+	ws.reconnectMutex.Lock()
+	closing := ws.closing
+	autoReconnect := ws.AutoReconnect
+	ws.reconnectMutex.Unlock()
+
+	if !autoReconnect || closing {
+		ws.setState(StateClosed, reason)
+		return false
 	}
-	ws.SendBytes(bytes)
-	return nil
+
+	ws.setState(StateReconnecting, reason)
+	ws.scheduleReconnect()
+	return true
 }
 
-func (ws *BasicWebsocket) attemptReconnect() bool {
-	if ws.AutoReconnect {
-		time.AfterFunc(ws.ReconnectTime, func() {
-			_ = ws.Reconnect()
-		})
-		return true
+func (ws *BasicWebsocket) nextReconnectDelay() (int, time.Duration, bool) {
+	ws.reconnectMutex.Lock()
+	defer ws.reconnectMutex.Unlock()
+
+	// the last connection was healthy long enough, so start counting again
+	if !ws.connectedAt.IsZero() && time.Since(ws.connectedAt) >= ws.ReconnectResetTime {
+		ws.reconnectAttempts = 0
+	}
+	ws.connectedAt = time.Time{}
+	ws.reconnectAttempts++
+
+	if ws.ReconnectPolicy == nil {
+		return ws.reconnectAttempts, ws.ReconnectTime, true
 	}
-	return false
+	delay, ok := ws.ReconnectPolicy.NextDelay(ws.reconnectAttempts)
+	return ws.reconnectAttempts, delay, ok
+}
+
+func (ws *BasicWebsocket) scheduleReconnect() {
+	attempt, delay, ok := ws.nextReconnectDelay()
+	if !ok {
+		err := fmt.Errorf("reconnect after %d attempts: %w", attempt-1, ErrReconnectGaveUp)
+		ws.setState(StateClosed, StateReason{Err: err})
+		ws.OnError(err)
+		return
+	}
+
+	ws.reconnectMutex.Lock()
+	defer ws.reconnectMutex.Unlock()
+	if ws.closing {
+		return
+	}
+
+	ws.wg.Add(1)
+	ws.reconnectTimer = time.AfterFunc(delay, func() {
+		defer ws.wg.Done()
+
+		// closed in the meantime
+		if ws.State() != StateReconnecting {
+			return
+		}
+
+		err := ws.Reconnect()
+		if err != nil && !errors.Is(err, ErrAlreadyConnected) && !errors.Is(err, ErrClosed) {
+			ws.OnError(fmt.Errorf("reconnect attempt %d: %w", attempt, err))
+			ws.scheduleReconnect()
+		}
+	})
 }
 
 // Reconnect immediately disconnect and reconnect
 func (ws *BasicWebsocket) Reconnect() error {
-	if ws.connected {
-		ws.ForceDisconnect()
+	return ws.reconnect(StateReason{})
+}
+
+func (ws *BasicWebsocket) reconnect(reason StateReason) error {
+	ws.connMutex.Lock()
+	closed := ws.closeConn()
+	ws.connMutex.Unlock()
+
+	if closed {
+		ws.setState(StateReconnecting, reason)
 	}
 
 	err := ws.Connect()
@@ -242,3 +501,110 @@ func (ws *BasicWebsocket) Reconnect() error {
 
 	return nil
 }
+
+// Close flushes queued messages, closes the connection without reconnecting and waits for the
+// reader, writer and any scheduled reconnect to stop. The websocket cannot be used afterwards.
+func (ws *BasicWebsocket) Close(ctx context.Context) error {
+	ws.reconnectMutex.Lock()
+	if !ws.closing {
+		ws.closing = true
+		close(ws.done)
+	}
+	if ws.reconnectTimer != nil && ws.reconnectTimer.Stop() {
+		// the reconnect will not run, so it will not mark itself done
+		ws.wg.Done()
+	}
+	ws.reconnectTimer = nil
+	ws.reconnectMutex.Unlock()
+
+	err := ws.flush(ctx)
+
+	ws.connMutex.Lock()
+	if ws.connected {
+		message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+		_ = ws.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(closeTimeout))
+	}
+	ws.closeConn()
+	ws.connMutex.Unlock()
+
+	ws.setState(StateClosed, StateReason{})
+
+	if waitErr := ws.wg.Wait(ctx); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// flush waits until everything queued so far was written, or the connection is gone
+func (ws *BasicWebsocket) flush(ctx context.Context) error {
+	ws.connMutex.Lock()
+	connected, closed := ws.connected, ws.closed
+	ws.connMutex.Unlock()
+	if !connected {
+		return nil
+	}
+
+	flushed := make(chan struct{})
+	select {
+	case ws.writerMessages <- frame{flushed: flushed}:
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-flushed:
+	case <-closed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return nil
+}
+
+// waitGroup counts goroutines like sync.WaitGroup, but waiting for it gives up when a
+// context is done without leaving a goroutine behind. The zero value is ready to use
+type waitGroup struct {
+	count int
+	// Closed once count drops back to zero
+	idle  chan struct{}
+	mutex sync.Mutex
+}
+
+func (wg *waitGroup) Add(delta int) {
+	wg.mutex.Lock()
+	defer wg.mutex.Unlock()
+
+	if wg.count == 0 {
+		wg.idle = make(chan struct{})
+	}
+	wg.count += delta
+	if wg.count < 0 {
+		panic("pubsub: negative waitGroup counter")
+	}
+	if wg.count == 0 {
+		close(wg.idle)
+	}
+}
+
+func (wg *waitGroup) Done() {
+	wg.Add(-1)
+}
+
+// Wait waits until the count is zero, giving up when ctx is done
+func (wg *waitGroup) Wait(ctx context.Context) error {
+	wg.mutex.Lock()
+	if wg.count == 0 {
+		wg.mutex.Unlock()
+		return nil
+	}
+	idle := wg.idle
+	wg.mutex.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
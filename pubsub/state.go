@@ -0,0 +1,60 @@
+package pubsub
+
+import (
+	"errors"
+
+	"github.com/gorilla/websocket"
+)
+
+// State is the connection state of a BasicWebsocket, Conn or Pool
+type State int
+
+// Connection states
+const (
+	// Not started yet
+	StateIdle State = iota
+	// Dialing for the first time, or again after being closed
+	StateConnecting
+	StateConnected
+	// Lost the connection and waiting for the reconnect policy to get it back
+	StateReconnecting
+	// Stopped, or gave up reconnecting
+	StateClosed
+)
+
+// String returns the name of the state
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "unknown"
+	}
+}
+
+// StateReason explains a state change. Both fields are empty for changes we asked for.
+type StateReason struct {
+	// Websocket close code sent by the server, 0 when there was no close frame
+	CloseCode int
+	// Error that caused the change
+	Err error
+}
+
+// closeReason builds the reason for a connection that failed with err
+func closeReason(err error) StateReason {
+	reason := StateReason{Err: err}
+
+	var closeErr *websocket.CloseError
+	if errors.As(err, &closeErr) {
+		reason.CloseCode = closeErr.Code
+	}
+	return reason
+}
@@ -0,0 +1,131 @@
+package pubsub
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// latencyWindow is the number of round trips the average and p99 latency are taken over
+const latencyWindow = 100
+
+// ConnStats are counters and measurements for a single Conn
+type ConnStats struct {
+	// Number of RECONNECT messages handled by moving to a new socket without a gap
+	Handovers int64
+	// Number of handovers that failed and fell back to a plain reconnect
+	FailedHandovers int64
+	// Time from the RECONNECT message until the new socket took over
+	LastHandover time.Duration
+	// Time without a listening socket around the last RECONNECT, zero when the handover succeeded
+	LastHandoverGap time.Duration
+	// Number of frames dropped because both sockets delivered them during a handover
+	OverlapDuplicates int64
+	// Number of events dropped by WithDeduplication. Connections of a Pool share the count
+	DuplicatesSuppressed int64
+
+	// PING/PONG round trip times, the average and p99 are over the last 100 round trips
+	LastLatency    time.Duration
+	AverageLatency time.Duration
+	P99Latency     time.Duration
+	// Number of pings that got no PONG before the deadline
+	MissedPongs int64
+	// Number of messages waiting to be written to the socket in use
+	WriteQueueDepth int
+}
+
+// PoolStats are counters for a Pool and all of its connections
+type PoolStats struct {
+	Connections int
+	Topics      int
+	// Number of events dropped by WithDeduplication
+	DuplicatesSuppressed int64
+	// Number of topics Compact moved to another connection
+	MovedTopics int64
+	// Number of connections Compact closed after moving their topics
+	ClosedConnections int64
+}
+
+// Stats returns a snapshot of the connection's counters
+func (c *Conn) Stats() ConnStats {
+	c.statsMutex.Lock()
+	stats := c.stats
+	stats.LastLatency = c.latency.last()
+	stats.AverageLatency = c.latency.average()
+	stats.P99Latency = c.latency.percentile(0.99)
+	c.statsMutex.Unlock()
+
+	stats.OverlapDuplicates = c.overlapFrames.Hits()
+	stats.WriteQueueDepth = c.socket().QueueDepth()
+	if c.events != nil {
+		stats.DuplicatesSuppressed = c.events.Hits()
+	}
+	return stats
+}
+
+// Stats returns a snapshot of the pool's counters
+func (p *Pool) Stats() PoolStats {
+	p.connectionsMutex.RLock()
+	defer p.connectionsMutex.RUnlock()
+
+	p.statsMutex.Lock()
+	stats := p.stats
+	p.statsMutex.Unlock()
+
+	stats.Connections = len(p.connections)
+	for _, conn := range p.connections {
+		stats.Topics += conn.Count()
+	}
+	if p.events != nil {
+		stats.DuplicatesSuppressed = p.events.Hits()
+	}
+	return stats
+}
+
+// latencyRing keeps the most recent round trip times
+type latencyRing struct {
+	samples []time.Duration
+	next    int
+}
+
+func (r *latencyRing) add(d time.Duration) {
+	if len(r.samples) < latencyWindow {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+	}
+	r.next = (r.next + 1) % latencyWindow
+}
+
+func (r *latencyRing) last() time.Duration {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	return r.samples[(r.next+latencyWindow-1)%latencyWindow]
+}
+
+func (r *latencyRing) average() time.Duration {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	var total time.Duration
+	for _, d := range r.samples {
+		total += d
+	}
+	return total / time.Duration(len(r.samples))
+}
+
+// percentile returns the smallest sample that p of the samples are at or below
+func (r *latencyRing) percentile(p float64) time.Duration {
+	if len(r.samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), r.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(math.Ceil(float64(len(sorted))*p)) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
@@ -1,6 +1,7 @@
 package pubsub
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +17,7 @@ const (
 	nonceLength     = 16
 	pingInterval    = time.Minute * 4
 	pongDeadline    = time.Second * 10
+	pingJitter      = time.Second * 3
 	twitchPubSubURL = "wss://pubsub-edge.twitch.tv"
 )
 
@@ -49,14 +51,24 @@ var (
 	// ErrBadTopic PubSub ERR_BADTOPIC response.
 	// OnError info: Topic that triggered the error.
 	ErrBadTopic = errors.New("pubsub ERR_BADTOPIC")
+
+	// ErrQueueFull is when a message was dropped because its delivery queue was full.
+	// OnError info: MessageData that was dropped.
+	ErrQueueFull = errors.New("delivery queue full")
+
+	// ErrCallbackPanic is when a topic callback panicked.
+	// OnError info: *PanicInfo with the message and stack.
+	ErrCallbackPanic = errors.New("callback panicked")
 )
 
 // Sub is something
 type Sub interface {
 	Listen(topic string, callback TopicCallback) (*Topic, error)
+	ListenContext(ctx context.Context, topic string, callback TopicCallback) (*Topic, error)
 	ListenMany(callback TopicCallback, topics ...string) ([]*Topic, error)
 
 	Unlisten(topic string) error
+	UnlistenContext(ctx context.Context, topic string) error
 	UnlistenMany(topics ...string) error
 
 	IsListening(topic string) bool
@@ -64,110 +76,323 @@ type Sub interface {
 
 // Conn is something
 type Conn struct {
-	ws        *BasicWebsocket
-	authToken string
+	ws              *BasicWebsocket
+	wsMutex         sync.RWMutex
+	header          http.Header
+	options         *options
+	reconnectPolicy ReconnectPolicy
+
+	tokens TokenSource
 
-	pingDone chan bool
-	pongChan chan bool
+	pingDone  chan bool
+	ping      *ping
+	pingMutex sync.Mutex
 
-	topics      []*Topic
+	// Topics by name, and by the nonce they were last listened to with
+	topics      map[string]*Topic
+	nonces      map[string]*Topic
 	topicsMutex sync.RWMutex
+	// Topics moved to another connection, whose late messages are ignored until the time given
+	released map[string]time.Time
+	// Token refreshes running after ERR_BADAUTH, by the rejected token
+	authRefreshes map[string]*authRefresh
+
+	pending  *pendingResponses
+	delivery *delivery
+
+	// LISTENs sent for several topics at once, by nonce
+	batches      map[string]*listenBatch
+	batchesMutex sync.Mutex
+	// Limits LISTEN and UNLISTEN messages, nil unless WithRateLimit was given
+	limiter *rateLimiter
+
+	middleware      []Middleware
+	middlewareMutex sync.RWMutex
+
+	handingOver   bool
+	overlapUntil  time.Time
+	overlapFrames *dedupeCache
+	handoverMutex sync.Mutex
+
+	// Events that already reached callbacks, nil unless WithDeduplication was given
+	events *dedupeCache
+
+	// Goroutines Close waits for, none are started once closing
+	wg         waitGroup
+	closed     chan struct{}
+	closing    bool
+	closeMutex sync.Mutex
+
+	stats          ConnStats
+	latency        latencyRing
+	disconnectedAt time.Time
+	// The next connect is the first since Start, nothing to spread out after a reconnect
+	firstConnect bool
+	statsMutex   sync.Mutex
+
+	// Called after this connection refreshed a rejected token
+	onTokenRefresh func(rejected, token string)
+	// Called after a topic was removed, whether unlistened or rejected by Twitch
+	onTopicRemoved func(topic *Topic)
 
 	// Called on connection connect
 	OnConnect func()
 	// Called on error
 	OnError func(err error, info interface{})
+	// Called when the state of the socket in use changes
+	OnStateChange func(from, to State, reason StateReason)
 }
 
 // NewConn is something
 func NewConn(authToken string, header http.Header) *Conn {
-	ws := NewBasicWebsocket(twitchPubSubURL, header)
-	ws.AutoReconnect = true
+	return NewConnWithOptions(authToken, header)
+}
+
+// NewConnWithOptions creates a Conn with a custom endpoint, dialer or TLS settings
+func NewConnWithOptions(authToken string, header http.Header, opts ...Option) *Conn {
+	o := newOptions(opts)
 
 	conn := &Conn{
-		ws:        ws,
-		authToken: authToken,
+		header:          header,
+		options:         o,
+		reconnectPolicy: NewExponentialBackoff(),
+
+		tokens: o.tokenSource,
 
 		pingDone: make(chan bool),
-		pongChan: make(chan bool),
+		closed:   make(chan struct{}),
+
+		topics:   make(map[string]*Topic),
+		nonces:   make(map[string]*Topic),
+		released: make(map[string]time.Time),
+		pending:  newPendingResponses(),
+		delivery: newDelivery(o),
+		batches:  make(map[string]*listenBatch),
+		limiter:  o.newRateLimiter(),
+
+		authRefreshes: make(map[string]*authRefresh),
+
+		middleware: o.middleware,
 
-		topics: make([]*Topic, 0),
+		overlapFrames: newDedupeCache(overlapCacheSize, overlapGrace+handoverTimeout),
+		events:        o.newEventCache(),
 
-		OnConnect: func() {},
-		OnError:   func(err error, info interface{}) {},
+		OnConnect:     func() {},
+		OnError:       func(err error, info interface{}) {},
+		OnStateChange: func(from, to State, reason StateReason) {},
+
+		onTokenRefresh: func(rejected, token string) {},
+		onTopicRemoved: func(topic *Topic) {},
+	}
+	if conn.tokens == nil {
+		conn.tokens = StaticToken(authToken)
 	}
 
-	ws.OnConnect = conn.connectHandler
-	ws.OnMessage = conn.rawMessageHandler
-	ws.OnError = func(err error) {
-		conn.OnError(err, nil)
+	conn.delivery.onOverflow = func(j job) {
+		conn.OnError(overflowError(j), j.data)
 	}
 
+	conn.ws = conn.newSocket()
 	return conn
 }
 
+// newSocket creates a websocket for this connection, it is replaced when handing over
+func (c *Conn) newSocket() *BasicWebsocket {
+	ws := NewBasicWebsocketWithQueue(c.options.url, c.header, c.options.writeQueueSize)
+	ws.Dialer = c.options.newDialer()
+	ws.AutoReconnect = true
+	ws.ReconnectPolicy = c.reconnectPolicy
+
+	ws.OnConnect = c.connectHandler
+	ws.OnMessage = func(data []byte) error {
+		return c.rawMessageHandler(ws, data)
+	}
+	ws.OnError = func(err error) {
+		c.OnError(err, nil)
+	}
+	ws.OnStateChange = func(from, to State, reason StateReason) {
+		// batches sent before the socket lost its connection will not be answered
+		if from == StateConnected {
+			c.dropBatches(ws)
+		}
+		// a socket being handed over to or away from does not change our state
+		if ws != c.socket() {
+			return
+		}
+		c.OnStateChange(from, to, reason)
+	}
+	return ws
+}
+
+// socket returns the websocket currently used for sending and delivering
+func (c *Conn) socket() *BasicWebsocket {
+	c.wsMutex.RLock()
+	defer c.wsMutex.RUnlock()
+	return c.ws
+}
+
 func (c *Conn) connectHandler() {
-	// stop any current ping goroutines
+	c.restartPing()
+
+	c.statsMutex.Lock()
+	if !c.disconnectedAt.IsZero() {
+		c.stats.LastHandoverGap = time.Since(c.disconnectedAt)
+		c.disconnectedAt = time.Time{}
+	}
+	jitter := c.options.relistenJitter
+	if c.firstConnect {
+		c.firstConnect = false
+		jitter = 0
+	}
+	c.statsMutex.Unlock()
+
+	// topics added from here on are listened to by Listen itself
+	ws := c.socket()
+	topics := c.topicsSnapshot()
+	c.goAsync(func() {
+		c.relistenAfterJitter(ws, topics, jitter)
+	})
+
+	c.OnConnect()
+}
+
+// restartPing stops any current ping goroutine and starts a new one
+func (c *Conn) restartPing() {
+	c.pingMutex.Lock()
+	defer c.pingMutex.Unlock()
+
+	c.stopPingLocked()
+	c.pingDone = c.startPing()
+}
+
+// stopPing stops the ping goroutine and abandons the outstanding ping
+func (c *Conn) stopPing() {
+	c.pingMutex.Lock()
+	defer c.pingMutex.Unlock()
+
+	c.stopPingLocked()
+}
+
+func (c *Conn) stopPingLocked() {
 	select {
 	case c.pingDone <- true:
 	default:
 		break
 	}
 
-	c.pingDone = c.startPing()
-
-	t, err := c.listenToAllTopics()
-	if err != nil {
-		c.OnError(err, t)
+	// a pong for the previous socket or connection must not count for the new one
+	if c.ping != nil {
+		close(c.ping.done)
+		c.ping = nil
 	}
+}
 
-	c.OnConnect()
+// goAsync runs f in a goroutine that Close waits for. Returns false once closing
+func (c *Conn) goAsync(f func()) bool {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+
+	if c.closing {
+		return false
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		f()
+	}()
+	return true
 }
 
-func (c *Conn) listenToTopic(topic *Topic) error {
-	return c.ws.SendJSON(topic.ListenMessage())
+func (c *Conn) listenToTopic(ctx context.Context, topic *Topic) error {
+	c.topicsMutex.RLock()
+	message := topic.ListenMessage()
+	c.topicsMutex.RUnlock()
+	return c.send(ctx, c.socket(), message)
 }
 
-func (c *Conn) unlistenToTopic(topic *Topic) error {
-	return c.ws.SendJSON(topic.UnlistenMessage())
+func (c *Conn) unlistenToTopic(ctx context.Context, topic *Topic) error {
+	return c.send(ctx, c.socket(), topic.UnlistenMessage())
 }
 
-func (c *Conn) listenToAllTopics() (*Topic, error) {
-	c.topicsMutex.RLock()
-	defer c.topicsMutex.RUnlock()
-	for _, topic := range c.topics {
-		err := c.listenToTopic(topic)
-		if err != nil {
-			return topic, err
+// listenToTopics listens again to the topics that are still registered after the socket connected
+func (c *Conn) listenToTopics(ws *BasicWebsocket, topics []*Topic) (*Topic, error) {
+	registered := make([]*Topic, 0, len(topics))
+	for _, topic := range topics {
+		if c.getTopicByName(topic.Name) == topic {
+			registered = append(registered, topic)
 		}
 	}
-	return nil, nil
+
+	return c.listenBatched(context.Background(), ws, registered)
 }
 
-func (c *Conn) rawMessageHandler(data []byte) (err error) {
+func (c *Conn) rawMessageHandler(ws *BasicWebsocket, data []byte) (err error) {
 	base := BaseMessage{}
 	err = json.Unmarshal(data, &base)
 	if err != nil {
 		return
 	}
 
+	// while handing over, only the socket in use may ask to reconnect or answer pings
+	current := ws == c.socket()
+
 	switch base.Type {
 	case "RECONNECT":
-		return c.ws.Reconnect()
+		if current {
+			c.goAsync(c.handover)
+		}
+		return
 	case "RESPONSE":
 		return c.onResponse(data)
 	case "MESSAGE":
+		if c.duplicateFrame(data) {
+			return
+		}
 		return c.onMessage(data)
 	case "PONG":
-		c.onPong()
+		c.onPong(ws)
 		return
 	default:
 		return
 	}
 }
 
-func (c *Conn) onPong() {
-	c.pongChan <- true
+// reconnect immediately, falling back to the reconnect policy if that fails
+func (c *Conn) reconnect(reason error) {
+	ws := c.socket()
+	err := ws.reconnect(StateReason{Err: reason})
+	if errors.Is(err, ErrClosed) {
+		return
+	}
+	if err != nil {
+		c.OnError(fmt.Errorf("reconnect: %w", err), nil)
+		ws.attemptReconnect(StateReason{Err: err})
+	}
+}
+
+// ping is a PING waiting for its PONG
+type ping struct {
+	ws   *BasicWebsocket
+	sent time.Time
+	// Closed once answered or abandoned
+	done chan struct{}
+}
+
+func (c *Conn) onPong(ws *BasicWebsocket) {
+	c.pingMutex.Lock()
+	p := c.ping
+	if p == nil || p.ws != ws {
+		// not the answer to our last ping
+		c.pingMutex.Unlock()
+		return
+	}
+	c.ping = nil
+	close(p.done)
+	c.pingMutex.Unlock()
+
+	c.statsMutex.Lock()
+	c.latency.add(time.Since(p.sent))
+	c.statsMutex.Unlock()
 }
 
 func (c *Conn) sendPing() error {
@@ -175,58 +400,120 @@ func (c *Conn) sendPing() error {
 		Type: "PING",
 	}
 
-	err := c.ws.SendJSON(message)
+	p := &ping{
+		ws:   c.socket(),
+		sent: time.Now(),
+		done: make(chan struct{}),
+	}
+	c.pingMutex.Lock()
+	if c.ping != nil {
+		close(c.ping.done)
+	}
+	c.ping = p
+	c.pingMutex.Unlock()
+
+	err := p.ws.SendJSON(message)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		timer := time.NewTimer(pongDeadline)
+	c.goAsync(func() {
+		timer := time.NewTimer(c.options.pongDeadline)
 		defer timer.Stop()
-		for {
-			select {
-			case <-c.pongChan:
-				return
-			case <-timer.C:
-				if !c.ws.IsConnected() {
-					return
-				}
+		select {
+		case <-p.done:
+			return
+		case <-c.closed:
+			return
+		case <-timer.C:
+		}
 
-				c.OnError(ErrPingTimeout, pongDeadline)
-				_ = c.ws.Reconnect()
-				return
-			}
+		c.pingMutex.Lock()
+		missed := c.ping == p
+		if missed {
+			c.ping = nil
 		}
-	}()
+		c.pingMutex.Unlock()
+
+		if !missed || !p.ws.IsConnected() || p.ws != c.socket() {
+			return
+		}
+
+		c.statsMutex.Lock()
+		c.stats.MissedPongs++
+		c.statsMutex.Unlock()
+
+		c.OnError(ErrPingTimeout, c.options.pongDeadline)
+		c.reconnect(ErrPingTimeout)
+	})
 
 	return nil
 }
 
 func (c *Conn) startPing() chan bool {
 	doneChan := make(chan bool, 1)
-	go func() {
-		fire := func() {
-			// Sleep 0-3 seconds for jitter
-			time.Sleep(time.Duration(rand.Intn(3000)) * time.Millisecond)
+	c.goAsync(func() {
+		jitter := pingJitter
+		if jitter > c.options.pingInterval/2 {
+			jitter = c.options.pingInterval / 2
+		}
+		fire := func() bool {
+			// Sleep up to 3 seconds for jitter
+			if jitter > 0 {
+				timer := time.NewTimer(time.Duration(rand.Int63n(int64(jitter))))
+				defer timer.Stop()
+				select {
+				case <-timer.C:
+				case <-doneChan:
+					return false
+				case <-c.closed:
+					return false
+				}
+			}
 			_ = c.sendPing()
+			return true
 		}
 
-		ticker := time.NewTicker(pingInterval)
-		fire()
+		ticker := time.NewTicker(c.options.pingInterval)
 		defer ticker.Stop()
+		if !fire() {
+			return
+		}
 		for {
 			select {
 			case <-ticker.C:
-				fire()
+				if !fire() {
+					return
+				}
 			case <-doneChan:
 				return
+			case <-c.closed:
+				return
 			}
 		}
-	}()
+	})
 
 	return doneChan
 }
 
+// responseError converts the error field of a RESPONSE into one of our errors
+func responseError(code string) error {
+	switch code {
+	case "":
+		return nil
+	case "ERR_BADMESSAGE":
+		return ErrBadMessage
+	case "ERR_BADAUTH":
+		return ErrBadAuth
+	case "ERR_SERVER":
+		return ErrServer
+	case "ERR_BADTOPIC":
+		return ErrBadTopic
+	default:
+		return fmt.Errorf("pubsub %s", code)
+	}
+}
+
 func (c *Conn) onResponse(data []byte) error {
 	response := ResponseMessage{}
 	err := json.Unmarshal(data, &response)
@@ -234,27 +521,194 @@ func (c *Conn) onResponse(data []byte) error {
 		return err
 	}
 
-	if response.Error != "" {
-		errorTopic := c.getTopicByNonce(response.Nonce)
-		if errorTopic == nil || !c.removeTopic(errorTopic) {
-			return fmt.Errorf("received error for invalid nonce %q: %w", response.Nonce, ErrInvalidTopic)
+	responseErr := responseError(response.Error)
+	if batch := c.takeBatch(response.Nonce); batch != nil {
+		c.onBatchResponse(batch, responseErr)
+		return nil
+	}
+	errorTopic := c.getTopicByNonce(response.Nonce)
+
+	// keep the topic and its waiter while we try again with a refreshed token
+	if errors.Is(responseErr, ErrBadAuth) && errorTopic != nil && c.startAuthRetry(errorTopic) {
+		return nil
+	}
+
+	waited := c.pending.resolve(response.Nonce, responseErr)
+	if responseErr == nil {
+		if errorTopic != nil {
+			c.topicsMutex.Lock()
+			errorTopic.authRetries = 0
+			c.topicsMutex.Unlock()
 		}
+		return nil
+	}
 
-		switch response.Error {
-		case "ERR_BADMESSAGE":
-			c.OnError(ErrBadMessage, errorTopic)
-		case "ERR_BADAUTH":
-			c.OnError(ErrBadAuth, errorTopic)
-		case "ERR_SERVER":
-			c.OnError(ErrServer, errorTopic)
-		case "ERR_BADTOPIC":
-			c.OnError(ErrBadTopic, errorTopic)
+	if errorTopic == nil || !c.removeTopic(errorTopic) {
+		if waited {
+			// a failed UNLISTEN, the caller already received the error
+			return nil
+		}
+		if errors.Is(responseErr, ErrBadAuth) {
+			// a late response for a nonce we already listened to again with a new token
+			return nil
 		}
+		return fmt.Errorf("received error for invalid nonce %q: %w", response.Nonce, ErrInvalidTopic)
 	}
 
+	c.OnError(responseErr, errorTopic)
 	return nil
 }
 
+// authRefresh is a token refresh for the topics Twitch rejected with the same token
+type authRefresh struct {
+	tokens TokenSource
+	topics []*Topic
+}
+
+// startAuthRetry refreshes the token of a topic rejected with ERR_BADAUTH, or has it wait for
+// the refresh of its token that is already running. Reports false if the topic may not be
+// retried, as it was rejected again right after a refresh.
+func (c *Conn) startAuthRetry(topic *Topic) bool {
+	c.topicsMutex.Lock()
+	if topic.authRetries > 0 {
+		c.topicsMutex.Unlock()
+		return false
+	}
+
+	// read now, another refresh may replace it before ours starts
+	rejected := topic.AuthToken
+	refresh, running := c.authRefreshes[rejected]
+	if !running {
+		refresh = &authRefresh{tokens: topic.tokens}
+		c.authRefreshes[rejected] = refresh
+	}
+	refresh.topics = append(refresh.topics, topic)
+	c.topicsMutex.Unlock()
+
+	if !running {
+		c.goAsync(func() {
+			c.refreshAuth(rejected, refresh)
+		})
+	}
+	return true
+}
+
+// refreshAuth gets a new token for the rejected one and listens again to every topic that used it.
+// If it cannot be refreshed, only the topics Twitch rejected are removed
+func (c *Conn) refreshAuth(rejected string, refresh *authRefresh) {
+	// topics rejected from here on start a new refresh
+	finish := func() []*Topic {
+		c.topicsMutex.Lock()
+		defer c.topicsMutex.Unlock()
+		delete(c.authRefreshes, rejected)
+		return refresh.topics
+	}
+
+	// already listened to again with a token refreshed elsewhere, e.g. by another connection
+	if !c.usesToken(rejected) {
+		finish()
+		return
+	}
+
+	// a refresh still running when we close is abandoned
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	token, err := refreshToken(ctx, refresh.tokens, rejected)
+	if err == nil && token == rejected {
+		err = ErrTokenNotRefreshable
+	}
+	if err != nil {
+		if !errors.Is(err, ErrTokenNotRefreshable) {
+			c.OnError(err, nil)
+		}
+
+		// the token may only lack the scope for these topics, so leave the others alone
+		for _, topic := range finish() {
+			c.topicsMutex.RLock()
+			changed := topic.AuthToken != rejected
+			c.topicsMutex.RUnlock()
+			if !changed {
+				c.rejectTopic(topic, ErrBadAuth)
+			}
+		}
+		return
+	}
+
+	c.relistenWithToken(rejected, token)
+	finish()
+	c.onTokenRefresh(rejected, token)
+}
+
+// rejectTopic removes a topic Twitch refused, failing its waiter
+func (c *Conn) rejectTopic(topic *Topic, err error) {
+	c.topicsMutex.RLock()
+	nonce := topic.Nonce
+	c.topicsMutex.RUnlock()
+
+	c.pending.resolve(nonce, err)
+	if c.removeTopic(topic) {
+		c.OnError(err, topic)
+	}
+}
+
+// usesToken reports whether any topic is still listened to with the token
+func (c *Conn) usesToken(token string) bool {
+	c.topicsMutex.RLock()
+	defer c.topicsMutex.RUnlock()
+
+	for _, topic := range c.topics {
+		if topic.AuthToken == token {
+			return true
+		}
+	}
+	return false
+}
+
+// relistenWithToken swaps the rejected token for the new one and sends LISTEN again for those topics,
+// batched as they share the token
+func (c *Conn) relistenWithToken(rejected, token string) {
+	var topics []*Topic
+
+	c.topicsMutex.Lock()
+	for _, topic := range c.topics {
+		if topic.AuthToken != rejected {
+			continue
+		}
+
+		nonce, err := GenerateRandomNonce(nonceLength)
+		if err != nil {
+			c.OnError(err, topic)
+			continue
+		}
+		c.pending.rename(topic.Nonce, nonce)
+
+		delete(c.nonces, topic.Nonce)
+		c.nonces[nonce] = topic
+		topic.Nonce = nonce
+		topic.AuthToken = token
+		topic.authRetries++
+		topics = append(topics, topic)
+	}
+	c.topicsMutex.Unlock()
+
+	ws := c.socket()
+	if !ws.IsConnected() || len(topics) == 0 {
+		return
+	}
+	t, err := c.listenBatched(context.Background(), ws, topics)
+	if err != nil {
+		c.OnError(err, t)
+	}
+}
+
 func (c *Conn) onMessage(data []byte) error {
 	message := MessageMessage{}
 	err := json.Unmarshal(data, &message)
@@ -264,39 +718,50 @@ func (c *Conn) onMessage(data []byte) error {
 
 	topic := c.getTopicByName(message.Data.Topic)
 	if topic == nil {
+		if c.isReleased(message.Data.Topic) {
+			return nil
+		}
 		return fmt.Errorf("received message for invalid topic %q: %w", message.Data.Topic, ErrInvalidTopic)
 	}
 
-	go topic.Callback(message.Data)
+	if topic.duplicate(message.Data) {
+		return nil
+	}
+	if c.events != nil && c.events.seen(eventIdentity(message.Data)) {
+		return nil
+	}
+
+	c.delivery.deliver(topic, message.Data)
 	return nil
 }
 
 func (c *Conn) getTopicByNonce(nonce string) *Topic {
 	c.topicsMutex.RLock()
 	defer c.topicsMutex.RUnlock()
-
-	for _, topic := range c.topics {
-		if topic.Nonce == nonce {
-			return topic
-		}
-	}
-	return nil
+	return c.nonces[nonce]
 }
 
 func (c *Conn) getTopicByName(name string) *Topic {
 	c.topicsMutex.RLock()
 	defer c.topicsMutex.RUnlock()
+	return c.topics[name]
+}
 
-	for _, topic := range c.topics {
-		if topic.Name == name {
-			return topic
-		}
+// indexTopicLocked registers the topic by name and nonce, topicsMutex must be held
+func (c *Conn) indexTopicLocked(topic *Topic) {
+	c.topics[topic.Name] = topic
+	c.nonces[topic.Nonce] = topic
+}
+
+// unindexTopicLocked unregisters the topic, topicsMutex must be held
+func (c *Conn) unindexTopicLocked(topic *Topic) {
+	delete(c.topics, topic.Name)
+	if c.nonces[topic.Nonce] == topic {
+		delete(c.nonces, topic.Nonce)
 	}
-	return nil
 }
 
-// Listen is something
-func (c *Conn) Listen(topic string, callback TopicCallback) (*Topic, error) {
+func (c *Conn) newTopic(topic string, tokens TokenSource, callback TopicCallback) (*Topic, error) {
 	if c.Capacity() == 0 {
 		return nil, ErrTooManyTopics
 	}
@@ -310,19 +775,92 @@ func (c *Conn) Listen(topic string, callback TopicCallback) (*Topic, error) {
 		return nil, err
 	}
 
-	newTopic := &Topic{
+	token, err := tokens.Token()
+	if err != nil {
+		return nil, fmt.Errorf("listen topic %q: %w", topic, err)
+	}
+
+	return &Topic{
 		Name:      topic,
 		Nonce:     nonce,
-		AuthToken: c.authToken,
-		Callback:  callback,
-	}
+		AuthToken: token,
+		Callback:  c.wrap(callback),
+		callback:  callback,
+		tokens:    tokens,
+	}, nil
+}
+
+// wrap applies the middleware chain, with panic recovery around all of it
+func (c *Conn) wrap(callback TopicCallback) TopicCallback {
+	c.middlewareMutex.RLock()
+	callback = chain(callback, c.middleware)
+	c.middlewareMutex.RUnlock()
+
+	return Recover(func(err error, info interface{}) {
+		c.OnError(err, info)
+	})(callback)
+}
+
+// Use adds middleware for topics listened to after this call
+func (c *Conn) Use(middleware ...Middleware) {
+	c.middlewareMutex.Lock()
+	c.middleware = append(c.middleware, middleware...)
+	c.middlewareMutex.Unlock()
+}
 
+// addTopic registers the topic, checking the limits again now that we hold the lock
+func (c *Conn) addTopic(topic *Topic) error {
 	c.topicsMutex.Lock()
-	c.topics = append(c.topics, newTopic)
-	c.topicsMutex.Unlock()
+	defer c.topicsMutex.Unlock()
+
+	if len(c.topics) >= maxTopics {
+		return ErrTooManyTopics
+	}
+	if _, ok := c.topics[topic.Name]; ok {
+		return fmt.Errorf("listen topic %q: %w", topic.Name, ErrDuplicateTopic)
+	}
+
+	if c.isClosing() {
+		return ErrClosed
+	}
+	err := c.delivery.start(topic)
+	if err != nil {
+		return err
+	}
+
+	c.indexTopicLocked(topic)
+	return nil
+}
+
+// Listen is something
+func (c *Conn) Listen(topic string, callback TopicCallback) (*Topic, error) {
+	return c.ListenWithTokenSource(topic, c.tokens, callback)
+}
+
+// ListenWithToken listens to a topic with its own access token instead of the connection's
+func (c *Conn) ListenWithToken(topic, token string, callback TopicCallback) (*Topic, error) {
+	return c.ListenWithTokenSource(topic, StaticToken(token), callback)
+}
+
+// ListenWithTokenSource listens to a topic with its own TokenSource, which is used
+// to refresh the token if Twitch rejects it
+func (c *Conn) ListenWithTokenSource(topic string, tokens TokenSource, callback TopicCallback) (*Topic, error) {
+	if tokens == nil {
+		tokens = c.tokens
+	}
+
+	newTopic, err := c.newTopic(topic, tokens, callback)
+	if err != nil {
+		return nil, err
+	}
 
-	if c.ws.IsConnected() {
-		err = c.listenToTopic(newTopic)
+	err = c.addTopic(newTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.socket().IsConnected() {
+		err = c.listenToTopic(context.Background(), newTopic)
 		if err != nil {
 			return nil, err
 		}
@@ -330,71 +868,175 @@ func (c *Conn) Listen(topic string, callback TopicCallback) (*Topic, error) {
 	return newTopic, nil
 }
 
-// ListenMany is something
+// ListenContext listens to a topic and waits until Twitch acknowledges it.
+// A rejected topic returns ErrBadAuth, ErrBadTopic, etc. and is not kept.
+// If ctx ends first the topic is unlistened and the context error is returned.
+// While disconnected, the acknowledgement is awaited from the next connect.
+func (c *Conn) ListenContext(ctx context.Context, topic string, callback TopicCallback) (*Topic, error) {
+	// sending may still win against a ctx that already ended, which would need an UNLISTEN
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("listen topic %q: %w", topic, err)
+	}
+
+	newTopic, err := c.newTopic(topic, c.tokens, callback)
+	if err != nil {
+		return nil, err
+	}
+
+	// register before the topic becomes visible to connectHandler
+	response := c.pending.add(newTopic.Nonce)
+	defer c.pending.remove(response)
+
+	err = c.addTopic(newTopic)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.socket().IsConnected() {
+		err = c.listenToTopic(ctx, newTopic)
+		if err != nil {
+			c.removeTopic(newTopic)
+			return nil, err
+		}
+	}
+
+	select {
+	case err = <-response:
+		if err != nil {
+			return nil, fmt.Errorf("listen topic %q: %w", topic, err)
+		}
+		return newTopic, nil
+	case <-ctx.Done():
+		_ = c.Unlisten(topic)
+		return nil, fmt.Errorf("listen topic %q: %w", topic, ctx.Err())
+	}
+}
+
+// ListenMany is something. Topics are listened to in batches, see WithRateLimit to spread them out
 func (c *Conn) ListenMany(callback TopicCallback, topics ...string) ([]*Topic, error) {
 	var returnedTopics []*Topic
+	var err error
 	for _, topic := range topics {
-		t, err := c.Listen(topic, callback)
+		var t *Topic
+		t, err = c.newTopic(topic, c.tokens, callback)
+		if err == nil {
+			err = c.addTopic(t)
+		}
 		if err != nil {
-			return nil, err
+			break
 		}
 		returnedTopics = append(returnedTopics, t)
 	}
+
+	// the topics added before an error are still listened to, as with Listen
+	if ws := c.socket(); ws.IsConnected() && len(returnedTopics) > 0 {
+		t, sendErr := c.listenBatched(context.Background(), ws, returnedTopics)
+		if sendErr != nil && err == nil {
+			err = fmt.Errorf("listen topic %q: %w", t.Name, sendErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 	return returnedTopics, nil
 }
 
+// removeTopic removes the registered topic with the same name and token, as Identifier would match
 func (c *Conn) removeTopic(topic *Topic) bool {
 	c.topicsMutex.Lock()
-	defer c.topicsMutex.Unlock()
-
-	index := -1
-	for i, t := range c.topics {
-		if t.Identifier() == topic.Identifier() {
-			index = i
-			break
-		}
-	}
 
-	if index == -1 {
+	removed, ok := c.topics[topic.Name]
+	if !ok || removed.AuthToken != topic.AuthToken {
+		c.topicsMutex.Unlock()
 		return false
 	}
 
-	// remove item at index
-	c.topics[index] = c.topics[len(c.topics)-1]
-	c.topics[len(c.topics)-1] = nil
-	c.topics = c.topics[:len(c.topics)-1]
+	c.delivery.stop(removed)
+	c.unindexTopicLocked(removed)
+	c.topicsMutex.Unlock()
 
+	c.onTopicRemoved(removed)
 	return true
 }
 
-// Unlisten is something
-func (c *Conn) Unlisten(topic string) error {
-	if c.getTopicByName(topic) == nil {
-		return fmt.Errorf("unlisten topic %q: %w", topic, ErrInvalidTopic)
+// removeTopicByName removes the topic and returns a copy with a fresh nonce for the UNLISTEN
+func (c *Conn) removeTopicByName(topic string) (*Topic, error) {
+	existing := c.getTopicByName(topic)
+	if existing == nil {
+		return nil, fmt.Errorf("unlisten topic %q: %w", topic, ErrInvalidTopic)
 	}
 
 	nonce, err := GenerateRandomNonce(nonceLength)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	c.topicsMutex.RLock()
+	token := existing.AuthToken
+	c.topicsMutex.RUnlock()
+
 	matchTopic := &Topic{
 		Name:      topic,
 		Nonce:     nonce,
-		AuthToken: c.authToken,
+		AuthToken: token,
 	}
 
 	c.removeTopic(matchTopic)
+	return matchTopic, nil
+}
 
-	if c.ws.IsConnected() {
-		err = c.unlistenToTopic(matchTopic)
-		if err != nil {
+// Unlisten is something
+func (c *Conn) Unlisten(topic string) error {
+	matchTopic, err := c.removeTopicByName(topic)
+	if err != nil {
+		return err
+	}
+
+	if c.socket().IsConnected() {
+		err = c.unlistenToTopic(context.Background(), matchTopic)
+		// closed in the meantime, e.g. retired by Pool.Compact once this was its last topic,
+		// so nothing is listened to anymore
+		if err != nil && !errors.Is(err, ErrClosed) {
 			return err
 		}
 	}
 	return nil
 }
 
+// UnlistenContext unlistens a topic and waits until Twitch acknowledges it.
+// The topic is removed locally even if the UNLISTEN fails or ctx ends first.
+func (c *Conn) UnlistenContext(ctx context.Context, topic string) error {
+	matchTopic, err := c.removeTopicByName(topic)
+	if err != nil {
+		return err
+	}
+
+	if !c.socket().IsConnected() {
+		return nil
+	}
+
+	response := c.pending.add(matchTopic.Nonce)
+	defer c.pending.remove(response)
+
+	err = c.unlistenToTopic(ctx, matchTopic)
+	if errors.Is(err, ErrClosed) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	select {
+	case err = <-response:
+		if err != nil {
+			return fmt.Errorf("unlisten topic %q: %w", topic, err)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("unlisten topic %q: %w", topic, ctx.Err())
+	}
+}
+
 // UnlistenMany is something
 func (c *Conn) UnlistenMany(topics ...string) error {
 	for _, topic := range topics {
@@ -425,9 +1067,29 @@ func (c *Conn) Capacity() int {
 	return maxTopics - len(c.topics)
 }
 
+// SetReconnectPolicy replaces the backoff used after unexpected disconnects
+func (c *Conn) SetReconnectPolicy(policy ReconnectPolicy) {
+	c.wsMutex.Lock()
+	defer c.wsMutex.Unlock()
+
+	c.reconnectPolicy = policy
+	c.ws.reconnectMutex.Lock()
+	c.ws.ReconnectPolicy = policy
+	c.ws.reconnectMutex.Unlock()
+}
+
+// State returns the state of the socket in use
+func (c *Conn) State() State {
+	return c.socket().State()
+}
+
 // Start is something
 func (c *Conn) Start() (err error) {
-	err = c.ws.Connect()
+	c.statsMutex.Lock()
+	c.firstConnect = true
+	c.statsMutex.Unlock()
+
+	err = c.socket().Connect()
 	if err != nil {
 		return
 	}
@@ -437,10 +1099,58 @@ func (c *Conn) Start() (err error) {
 
 // Stop is something
 func (c *Conn) Stop() {
-	if !c.ws.IsConnected() {
+	if !c.socket().IsConnected() {
+		// stops a pending reconnect
+		c.socket().ForceDisconnect()
 		return
 	}
 
-	c.ws.ForceDisconnect()
-	c.pingDone <- true
+	c.socket().ForceDisconnect()
+	c.stopPing()
+}
+
+func (c *Conn) isClosing() bool {
+	c.closeMutex.Lock()
+	defer c.closeMutex.Unlock()
+	return c.closing
+}
+
+// Close stops the connection for good. It flushes queued messages, cancels a scheduled
+// reconnect, stops the ping and delivery goroutines and waits for all of them, or until
+// ctx is done. Running callbacks are waited for as well. Every topic is removed.
+func (c *Conn) Close(ctx context.Context) error {
+	c.closeMutex.Lock()
+	if !c.closing {
+		c.closing = true
+		close(c.closed)
+	}
+	c.closeMutex.Unlock()
+
+	// a handover in progress either swapped sockets already or will not anymore
+	err := c.socket().Close(ctx)
+	c.stopPing()
+
+	// the topics go with the connection
+	c.topicsMutex.Lock()
+	removed := make([]*Topic, 0, len(c.topics))
+	for _, topic := range c.topics {
+		c.delivery.stop(topic)
+		removed = append(removed, topic)
+	}
+	c.topics = make(map[string]*Topic)
+	c.nonces = make(map[string]*Topic)
+	c.topicsMutex.Unlock()
+	c.delivery.close()
+
+	for _, topic := range removed {
+		c.onTopicRemoved(topic)
+	}
+
+	if waitErr := c.wg.Wait(ctx); waitErr != nil {
+		return waitErr
+	}
+	if waitErr := c.delivery.wg.Wait(ctx); waitErr != nil {
+		return waitErr
+	}
+	return err
 }
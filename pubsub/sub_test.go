@@ -0,0 +1,150 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// requestLog records the LISTENs and UNLISTENs the fake server received, by topic
+type requestLog struct {
+	requests map[string][]string
+	mutex    sync.Mutex
+}
+
+func logRequests(fs *fakeServer) *requestLog {
+	log := &requestLog{requests: make(map[string][]string)}
+	fs.onRequest = func(fc *fakeClient, request testRequest) {
+		log.mutex.Lock()
+		defer log.mutex.Unlock()
+		for _, topic := range request.Data.Topics {
+			log.requests[topic] = append(log.requests[topic], request.Type)
+		}
+	}
+	return log
+}
+
+func (l *requestLog) get(topic string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.requests[topic]...)
+}
+
+// newTestConn creates a conn on the fake server and closes it when the test ends
+func newTestConn(t *testing.T, fs *fakeServer) *Conn {
+	t.Helper()
+
+	conn := NewConnWithOptions("token", nil, WithURL(fs.url()))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	})
+	return conn
+}
+
+func TestListenContextRejected(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{code: "ERR_BADTOPIC", want: ErrBadTopic},
+		{code: "ERR_BADAUTH", want: ErrBadAuth},
+		{code: "ERR_SERVER", want: ErrServer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.code, func(t *testing.T) {
+			const topic = "topic.rejected"
+
+			fs := newFakeServer(t)
+			fs.reject = func(request testRequest) string {
+				return test.code
+			}
+			conn := newTestConn(t, fs)
+			if err := conn.Start(); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			listened, err := conn.ListenContext(ctx, topic, nil)
+			if !errors.Is(err, test.want) || listened != nil {
+				t.Errorf("listen = %v, %v, want %v", listened, err, test.want)
+			}
+			if conn.IsListening(topic) || conn.Count() != 0 {
+				t.Errorf("rejected topic kept, %d topics", conn.Count())
+			}
+		})
+	}
+}
+
+func TestListenContextExpired(t *testing.T) {
+	const topic = "topic.expired"
+
+	fs := newFakeServer(t)
+	log := logRequests(fs)
+	conn := newTestConn(t, fs)
+
+	// not connected, so the LISTEN would only be sent on connect
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := conn.ListenContext(ctx, topic, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("listen = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if conn.IsListening(topic) || conn.Count() != 0 {
+		t.Errorf("expired topic kept, %d topics", conn.Count())
+	}
+
+	// and connected, with a ctx that already ended
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.ListenContext(ctx, topic, nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("listen = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	if _, err := conn.ListenContext(context.Background(), "topic.other", nil); err != nil {
+		t.Fatal(err)
+	}
+	if requests := log.get(topic); len(requests) != 0 {
+		t.Errorf("server received %v for the expired topic", requests)
+	}
+	if conn.IsListening(topic) || conn.Count() != 1 {
+		t.Errorf("expired topic kept, %d topics", conn.Count())
+	}
+}
+
+func TestUnlistenContext(t *testing.T) {
+	const topic = "topic.unlisten"
+
+	fs := newFakeServer(t)
+	log := logRequests(fs)
+	conn := newTestConn(t, fs)
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := conn.ListenContext(ctx, topic, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.UnlistenContext(ctx, topic); err != nil {
+		t.Fatal(err)
+	}
+
+	if conn.IsListening(topic) || fs.client(0).listening(topic) {
+		t.Error("still listening after UnlistenContext")
+	}
+	if requests := log.get(topic); len(requests) != 2 || requests[0] != "LISTEN" || requests[1] != "UNLISTEN" {
+		t.Errorf("server received %v, want LISTEN then UNLISTEN", requests)
+	}
+	if err := conn.UnlistenContext(ctx, topic); !errors.Is(err, ErrInvalidTopic) {
+		t.Errorf("second unlisten = %v, want %v", err, ErrInvalidTopic)
+	}
+}
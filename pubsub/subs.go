@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Subscription contexts, used as the message type of SubscribeEvent
+const (
+	ContextSub           = "sub"
+	ContextResub         = "resub"
+	ContextSubGift       = "subgift"
+	ContextAnonSubGift   = "anonsubgift"
+	ContextResubGift     = "resubgift"
+	ContextAnonResubGift = "anonresubgift"
+)
+
+// SubMessage is the message a user shared with their subscription
+type SubMessage struct {
+	Message string `json:"message"`
+	Emotes  []struct {
+		Start int `json:"start"`
+		End   int `json:"end"`
+		ID    int `json:"id"`
+	} `json:"emotes"`
+}
+
+// SubscribeEvent is from channel-subscribe-events-v1, covering subs, resubs and gifts.
+// For anonymous gifts the gifting user fields are empty.
+type SubscribeEvent struct {
+	UserName         string     `json:"user_name"`
+	DisplayName      string     `json:"display_name"`
+	ChannelName      string     `json:"channel_name"`
+	UserID           string     `json:"user_id"`
+	ChannelID        string     `json:"channel_id"`
+	Time             time.Time  `json:"time"`
+	SubPlan          string     `json:"sub_plan"`
+	SubPlanName      string     `json:"sub_plan_name"`
+	Months           int        `json:"months"`
+	CumulativeMonths int        `json:"cumulative_months"`
+	StreakMonths     int        `json:"streak_months"`
+	Context          string     `json:"context"`
+	IsGift           bool       `json:"is_gift"`
+	SubMessage       SubMessage `json:"sub_message"`
+
+	// Only set for gifts
+	RecipientID          string `json:"recipient_id"`
+	RecipientUserName    string `json:"recipient_user_name"`
+	RecipientDisplayName string `json:"recipient_display_name"`
+	// Number of months gifted at once, for multi-month gifts
+	MultiMonthDuration int `json:"multi_month_duration"`
+}
+
+// MessageType implements Event
+func (e *SubscribeEvent) MessageType() string { return e.Context }
+
+// Gift reports whether the subscription was gifted
+func (e *SubscribeEvent) Gift() bool {
+	switch e.Context {
+	case ContextSubGift, ContextAnonSubGift, ContextResubGift, ContextAnonResubGift:
+		return true
+	}
+	return e.IsGift
+}
+
+// AnonymousGift reports whether the subscription was gifted anonymously
+func (e *SubscribeEvent) AnonymousGift() bool {
+	return e.Context == ContextAnonSubGift || e.Context == ContextAnonResubGift
+}
+
+// Resub reports whether the user was already subscribed before
+func (e *SubscribeEvent) Resub() bool {
+	return e.Context == ContextResub || e.Context == ContextResubGift || e.Context == ContextAnonResubGift
+}
+
+// MultiMonth reports whether several months were gifted at once
+func (e *SubscribeEvent) MultiMonth() bool {
+	return e.MultiMonthDuration > 1
+}
+
+// DecodeSubscription decodes a channel-subscribe-events-v1 message
+func DecodeSubscription(data MessageData) (*SubscribeEvent, error) {
+	event := &SubscribeEvent{}
+	err := json.Unmarshal([]byte(data.Message), event)
+	if err != nil {
+		return nil, fmt.Errorf("decode subscription message on %s: %w", data.Topic, err)
+	}
+	return event, nil
+}
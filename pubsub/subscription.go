@@ -0,0 +1,215 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Subscription is a single handler registered with Pool.Subscribe
+type Subscription struct {
+	// Name of the subscribed topic
+	Topic string
+
+	pool      *Pool
+	callback  TopicCallback
+	done      <-chan struct{}
+	closeOnce sync.Once
+}
+
+// subscriberSet holds every handler for one topic that is listened to once
+type subscriberSet struct {
+	topic *Topic
+
+	subscriptions []*Subscription
+	mutex         sync.RWMutex
+}
+
+func (s *subscriberSet) add(sub *Subscription) {
+	s.mutex.Lock()
+	s.subscriptions = append(s.subscriptions, sub)
+	s.mutex.Unlock()
+}
+
+// remove takes the subscription out of the set. Returns how many are left
+func (s *subscriberSet) remove(sub *Subscription) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// copy so that a dispatch in progress keeps its own snapshot
+	remaining := make([]*Subscription, 0, len(s.subscriptions))
+	for _, existing := range s.subscriptions {
+		if existing != sub {
+			remaining = append(remaining, existing)
+		}
+	}
+	s.subscriptions = remaining
+	return len(remaining)
+}
+
+// dispatch is the topic callback, handing every message to each subscription in order
+func (s *subscriberSet) dispatch(data MessageData) {
+	s.mutex.RLock()
+	subscriptions := s.subscriptions
+	s.mutex.RUnlock()
+
+	for _, sub := range subscriptions {
+		sub.callback(data)
+	}
+}
+
+// Subscribe adds a handler for the topic. The topic is listened to once and every
+// message is handed to all of its subscriptions. Topics listened to directly with
+// Listen cannot also be subscribed to.
+func (p *Pool) Subscribe(topic string, callback TopicCallback) (*Subscription, error) {
+	p.subscribersMutex.Lock()
+	defer p.subscribersMutex.Unlock()
+
+	// start over if the topic we listened to for the set is gone
+	set, ok := p.subscribers[topic]
+	if current, _ := p.getTopicByName(topic); !ok || current != set.topic {
+		set = &subscriberSet{}
+		t, err := p.Listen(topic, set.dispatch)
+		if err != nil {
+			return nil, fmt.Errorf("subscribe: %w", err)
+		}
+		set.topic = t
+		p.subscribers[topic] = set
+	}
+
+	sub := &Subscription{
+		Topic: topic,
+		pool:  p,
+		done:  set.topic.Done(),
+	}
+
+	// recover each handler separately so one panic does not skip the others
+	sub.callback = Recover(func(err error, info interface{}) {
+		_, conn := p.getTopicByName(topic)
+		p.OnError(conn, err, info)
+	})(p.route(callback))
+
+	set.add(sub)
+	return sub, nil
+}
+
+func (p *Pool) unsubscribe(sub *Subscription) error {
+	p.subscribersMutex.Lock()
+	defer p.subscribersMutex.Unlock()
+
+	set, ok := p.subscribers[sub.Topic]
+	if !ok || set.remove(sub) > 0 {
+		return nil
+	}
+
+	delete(p.subscribers, sub.Topic)
+
+	// the topic may already be gone, e.g. after ERR_BADTOPIC
+	if current, _ := p.getTopicByName(sub.Topic); current != set.topic {
+		return nil
+	}
+	return p.Unlisten(sub.Topic)
+}
+
+// Done returns a channel that is closed once the topic is no longer listened to
+func (s *Subscription) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close removes the handler. The topic is unlistened once its last subscription is closed
+func (s *Subscription) Close() (err error) {
+	s.closeOnce.Do(func() {
+		err = s.pool.unsubscribe(s)
+	})
+	return
+}
+
+// chanSubscriber forwards messages from subscriptions into a channel
+type chanSubscriber struct {
+	messages      chan MessageData
+	subscriptions []*Subscription
+
+	stop      chan struct{}
+	closed    bool
+	mutex     sync.RWMutex
+	closeOnce sync.Once
+}
+
+// send waits for room in the channel, giving up once the channel is being closed
+func (cs *chanSubscriber) send(data MessageData) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	if cs.closed {
+		return
+	}
+	select {
+	case cs.messages <- data:
+	case <-cs.stop:
+	}
+}
+
+func (cs *chanSubscriber) close() {
+	cs.closeOnce.Do(func() {
+		// unblock any send before taking the write lock
+		close(cs.stop)
+		for _, sub := range cs.subscriptions {
+			_ = sub.Close()
+		}
+
+		cs.mutex.Lock()
+		cs.closed = true
+		close(cs.messages)
+		cs.mutex.Unlock()
+	})
+}
+
+// SubscribeChan subscribes to the topics and returns their messages on a channel.
+// The channel is closed when ctx is cancelled or once none of the topics are listened to anymore.
+//
+// The channel is buffered, see WithChanBuffer. When the buffer is full the subscription waits
+// for the consumer, which holds up delivery for the topic so further messages are handled by
+// the OverflowPolicy of the Pool.
+func (p *Pool) SubscribeChan(ctx context.Context, topics ...string) (<-chan MessageData, error) {
+	cs := &chanSubscriber{
+		messages: make(chan MessageData, p.chanBuffer),
+		stop:     make(chan struct{}),
+	}
+
+	for _, topic := range topics {
+		sub, err := p.Subscribe(topic, cs.send)
+		if err != nil {
+			cs.close()
+			return nil, err
+		}
+		cs.subscriptions = append(cs.subscriptions, sub)
+	}
+
+	// close once every topic is gone
+	var wg sync.WaitGroup
+	for _, sub := range cs.subscriptions {
+		wg.Add(1)
+		go func(done <-chan struct{}) {
+			defer wg.Done()
+			select {
+			case <-done:
+			case <-cs.stop:
+			}
+		}(sub.Done())
+	}
+	go func() {
+		wg.Wait()
+		cs.close()
+	}()
+
+	// or when the context ends
+	go func() {
+		select {
+		case <-ctx.Done():
+			cs.close()
+		case <-cs.stop:
+		}
+	}()
+
+	return cs.messages, nil
+}
@@ -0,0 +1,205 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// twitchTokenURL is where Twitch hands out refreshed OAuth tokens
+	twitchTokenURL = "https://id.twitch.tv/oauth2/token"
+	// defaultRefreshTimeout bounds a token refresh with the default HTTP client
+	defaultRefreshTimeout = time.Second * 10
+)
+
+// ErrTokenNotRefreshable is when a TokenSource has no way to get a new token
+var ErrTokenNotRefreshable = errors.New("token cannot be refreshed")
+
+// TokenSource provides the access token used to listen to topics
+type TokenSource interface {
+	// Token returns the current access token
+	Token() (string, error)
+	// Refresh returns a new access token after rejected was refused by Twitch.
+	// If the token was already refreshed since, the current token is returned.
+	Refresh(rejected string) (string, error)
+}
+
+// ContextTokenSource is a TokenSource whose refresh can be cancelled. Connections use
+// RefreshContext when available, so a refresh stops once the connection is closed
+type ContextTokenSource interface {
+	TokenSource
+	RefreshContext(ctx context.Context, rejected string) (string, error)
+}
+
+// refreshToken refreshes with RefreshContext if the TokenSource supports it
+func refreshToken(ctx context.Context, tokens TokenSource, rejected string) (string, error) {
+	if source, ok := tokens.(ContextTokenSource); ok {
+		return source.RefreshContext(ctx, rejected)
+	}
+	return tokens.Refresh(rejected)
+}
+
+// StaticToken is a TokenSource for a token that cannot be refreshed
+type StaticToken string
+
+// Token implements TokenSource
+func (t StaticToken) Token() (string, error) {
+	return string(t), nil
+}
+
+// Refresh implements TokenSource, it always fails
+func (t StaticToken) Refresh(rejected string) (string, error) {
+	return "", ErrTokenNotRefreshable
+}
+
+// RefreshTokenSource refreshes the access token with Twitch's OAuth refresh grant
+type RefreshTokenSource struct {
+	ClientID     string
+	ClientSecret string
+	// Defaults to the Twitch token endpoint
+	TokenURL string
+	// Defaults to a client with a 10 second timeout
+	HTTPClient *http.Client
+	// Called with the new tokens after every refresh, for example to store them
+	OnRefresh func(accessToken, refreshToken string)
+
+	accessToken  string
+	refreshToken string
+	// Refresh in progress, shared by everyone waiting for it
+	refreshing *refreshCall
+	mutex      sync.Mutex
+}
+
+// refreshCall is a refresh other callers can wait for
+type refreshCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// NewRefreshTokenSource creates a TokenSource starting from the given tokens
+func NewRefreshTokenSource(clientID, clientSecret, accessToken, refreshToken string) *RefreshTokenSource {
+	return &RefreshTokenSource{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenURL:     twitchTokenURL,
+		HTTPClient:   &http.Client{Timeout: defaultRefreshTimeout},
+		OnRefresh:    func(accessToken, refreshToken string) {},
+
+		accessToken:  accessToken,
+		refreshToken: refreshToken,
+	}
+}
+
+// Token implements TokenSource
+func (s *RefreshTokenSource) Token() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accessToken, nil
+}
+
+// refreshResponse is the body Twitch returns for the refresh grant
+type refreshResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	Message      string `json:"message"`
+}
+
+// Refresh implements TokenSource, see RefreshContext
+func (s *RefreshTokenSource) Refresh(rejected string) (string, error) {
+	return s.RefreshContext(context.Background(), rejected)
+}
+
+// RefreshContext implements ContextTokenSource. Concurrent callers with the same rejected token
+// share one refresh, and Token keeps returning the current token while it runs
+func (s *RefreshTokenSource) RefreshContext(ctx context.Context, rejected string) (string, error) {
+	s.mutex.Lock()
+	if rejected != s.accessToken {
+		defer s.mutex.Unlock()
+		return s.accessToken, nil
+	}
+	if s.refreshToken == "" {
+		s.mutex.Unlock()
+		return "", ErrTokenNotRefreshable
+	}
+
+	call := s.refreshing
+	if call != nil {
+		s.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.token, call.err
+		case <-ctx.Done():
+			return "", fmt.Errorf("refresh token: %w", ctx.Err())
+		}
+	}
+
+	call = &refreshCall{done: make(chan struct{})}
+	s.refreshing = call
+	refreshToken := s.refreshToken
+	s.mutex.Unlock()
+
+	accessToken, newRefreshToken, err := s.refresh(ctx, refreshToken)
+
+	s.mutex.Lock()
+	s.refreshing = nil
+	if err == nil {
+		s.accessToken = accessToken
+		if newRefreshToken != "" {
+			s.refreshToken = newRefreshToken
+		}
+		newRefreshToken = s.refreshToken
+	}
+	s.mutex.Unlock()
+
+	call.token, call.err = accessToken, err
+	close(call.done)
+
+	if err != nil {
+		return "", err
+	}
+	s.OnRefresh(accessToken, newRefreshToken)
+	return accessToken, nil
+}
+
+// refresh asks Twitch for new tokens, without holding the mutex
+func (s *RefreshTokenSource) refresh(ctx context.Context, refreshToken string) (string, string, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+		"client_id":     {s.ClientID},
+		"client_secret": {s.ClientSecret},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", fmt.Errorf("refresh token: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := s.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: defaultRefreshTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("refresh token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body := refreshResponse{}
+	err = json.NewDecoder(resp.Body).Decode(&body)
+	if err != nil {
+		return "", "", fmt.Errorf("refresh token: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || body.AccessToken == "" {
+		return "", "", fmt.Errorf("refresh token: %s: %s", resp.Status, body.Message)
+	}
+	return body.AccessToken, body.RefreshToken, nil
+}
@@ -0,0 +1,173 @@
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRefreshTokenSourceDoesNotBlockToken(t *testing.T) {
+	release := make(chan struct{})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		_, _ = w.Write([]byte(`{"access_token":"new","refresh_token":"refresh2"}`))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	source := NewRefreshTokenSource("id", "secret", "old", "refresh")
+	source.TokenURL = server.URL
+
+	// a refresh that stalls holds up neither Token nor a caller whose ctx ends
+	results := make(chan string, 2)
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			token, err := source.Refresh("old")
+			if err != nil {
+				t.Errorf("refresh: %v", err)
+			}
+			results <- token
+		}()
+	}
+	waitFor(t, time.Second, func() bool {
+		return atomic.LoadInt32(&requests) == 1
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if token, _ := source.Token(); token != "old" {
+			t.Errorf("token during refresh = %q, want old", token)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Token blocked by a running refresh")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := source.RefreshContext(ctx, "old"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("refresh with expired ctx = %v, want deadline exceeded", err)
+	}
+
+	release <- struct{}{}
+	wg.Wait()
+	close(results)
+	for token := range results {
+		if token != "new" {
+			t.Errorf("refreshed token = %q, want new", token)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("refresh requests = %d, want 1", n)
+	}
+	if token, _ := source.Token(); token != "new" {
+		t.Errorf("token after refresh = %q, want new", token)
+	}
+}
+
+// countingTokens hands out "new" once refreshed, counting the refreshes
+type countingTokens struct {
+	token     string
+	refreshes int
+	mutex     sync.Mutex
+}
+
+func (c *countingTokens) Token() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token, nil
+}
+
+func (c *countingTokens) Refresh(rejected string) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.refreshes++
+	c.token = "new"
+	return c.token, nil
+}
+
+func (c *countingTokens) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refreshes
+}
+
+func TestConnRefreshesRejectedTokenOnce(t *testing.T) {
+	const topics = 20
+
+	fs := newFakeServer(t)
+	var mutex sync.Mutex
+	listened := make(map[string]int)
+	fs.reject = func(request testRequest) string {
+		if request.Data.AuthToken == "old" {
+			return "ERR_BADAUTH"
+		}
+		mutex.Lock()
+		for _, topic := range request.Data.Topics {
+			listened[topic]++
+		}
+		mutex.Unlock()
+		return ""
+	}
+
+	tokens := &countingTokens{token: "old"}
+	// every topic is answered on its own
+	conn := NewConnWithOptions("", nil, WithURL(fs.url()), WithTokenSource(tokens), WithListenBatchSize(1))
+	conn.OnError = func(err error, info interface{}) {
+		t.Errorf("conn error: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Close(ctx); err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+
+	for i := 0; i < topics; i++ {
+		if _, err := conn.Listen(fmt.Sprintf("topic.%d", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conn.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 2*time.Second, func() bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return len(listened) == topics
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	if n := tokens.count(); n != 1 {
+		t.Errorf("refreshes = %d, want 1", n)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for topic, n := range listened {
+		if n != 1 {
+			t.Errorf("topic %s listened to %d times with the new token", topic, n)
+		}
+	}
+	for i := 0; i < topics; i++ {
+		name := fmt.Sprintf("topic.%d", i)
+		if !conn.IsListening(name) || !fs.client(0).listening(name) {
+			t.Errorf("not listening to %s", name)
+		}
+	}
+}
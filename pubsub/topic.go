@@ -1,6 +1,11 @@
 package pubsub
 
-import "fmt"
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+	"time"
+)
 
 // Topic is something
 type Topic struct {
@@ -8,11 +13,39 @@ type Topic struct {
 	Nonce     string
 	AuthToken string
 	Callback  TopicCallback
+
+	// The callback as passed to Listen, before the connection wrapped it
+	callback      TopicCallback
+	callbackMutex sync.RWMutex
+
+	// Where AuthToken came from, used to refresh it
+	tokens TokenSource
+	// Number of times the topic was listened to again with a refreshed token
+	authRetries int
+
+	queue    chan job
+	done     chan struct{}
+	stopOnce sync.Once
+
+	// Closed to stop the ordered worker without ending delivery, when the topic moves
+	// to another connection
+	workerStop   chan struct{}
+	workerExited chan struct{}
+
+	// Set while the topic moves between connections, as both deliver it for a while
+	overlapMessages *dedupeCache
+	overlapUntil    time.Time
+	overlapMutex    sync.Mutex
 }
 
 // TopicCallback is something
 type TopicCallback func(MessageData)
 
+// Done returns a channel that is closed once the topic is no longer listened to
+func (t *Topic) Done() <-chan struct{} {
+	return t.done
+}
+
 // ListenMessage is something
 func (t *Topic) ListenMessage() RequestMessage {
 	return RequestMessage{
@@ -44,3 +77,50 @@ func (t *Topic) UnlistenMessage() RequestMessage {
 func (t *Topic) Identifier() string {
 	return mustHashString(fmt.Sprintf("%s:%s", t.Name, t.AuthToken))
 }
+
+// call runs the callback, which changes when the topic moves to another connection
+func (t *Topic) call(data MessageData) {
+	t.callbackMutex.RLock()
+	callback := t.Callback
+	t.callbackMutex.RUnlock()
+	callback(data)
+}
+
+// setCallback replaces the callback, wrapped by the connection the topic moved to
+func (t *Topic) setCallback(callback TopicCallback) {
+	t.callbackMutex.Lock()
+	t.Callback = callback
+	t.callbackMutex.Unlock()
+}
+
+// startOverlap drops messages that were already delivered, until endOverlap
+func (t *Topic) startOverlap() {
+	t.overlapMutex.Lock()
+	t.overlapMessages = newDedupeCache(overlapCacheSize, moveTimeout+overlapGrace)
+	t.overlapUntil = time.Time{}
+	t.overlapMutex.Unlock()
+}
+
+// endOverlap keeps dropping repeated messages for the grace period, for those still in flight
+func (t *Topic) endOverlap() {
+	t.overlapMutex.Lock()
+	t.overlapUntil = time.Now().Add(overlapGrace)
+	t.overlapMutex.Unlock()
+}
+
+// duplicate reports whether the message was already delivered by the other connection
+func (t *Topic) duplicate(data MessageData) bool {
+	t.overlapMutex.Lock()
+	defer t.overlapMutex.Unlock()
+
+	if t.overlapMessages == nil {
+		return false
+	}
+	if !t.overlapUntil.IsZero() && time.Now().After(t.overlapUntil) {
+		t.overlapMessages = nil
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(data.Message))
+	return t.overlapMessages.seen(string(sum[:]))
+}
@@ -0,0 +1,156 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrMalformedTopic is when a topic name or one of its IDs is not valid
+var ErrMalformedTopic = errors.New("malformed topic")
+
+// TopicKind is the part of a topic name before the first ID
+type TopicKind string
+
+// Every topic kind supported by Twitch PubSub
+const (
+	KindBits                        TopicKind = "channel-bits-events-v1"
+	KindBitsV2                      TopicKind = "channel-bits-events-v2"
+	KindBitsBadgeUnlocks            TopicKind = "channel-bits-badge-unlocks"
+	KindChannelPoints               TopicKind = "channel-points-channel-v1"
+	KindSubscriptions               TopicKind = "channel-subscribe-events-v1"
+	KindModeratorActions            TopicKind = "chat_moderator_actions"
+	KindWhispers                    TopicKind = "whispers"
+	KindAutoModQueue                TopicKind = "automod-queue"
+	KindUserModerationNotifications TopicKind = "user-moderation-notifications"
+)
+
+// topicKindInfo is what we need to know to build and parse a topic kind
+type topicKindInfo struct {
+	scope string
+	ids   []string
+}
+
+var topicKinds = map[TopicKind]topicKindInfo{
+	KindBits:                        {scope: "bits:read", ids: []string{"channel ID"}},
+	KindBitsV2:                      {scope: "bits:read", ids: []string{"channel ID"}},
+	KindBitsBadgeUnlocks:            {scope: "bits:read", ids: []string{"channel ID"}},
+	KindChannelPoints:               {scope: "channel:read:redemptions", ids: []string{"channel ID"}},
+	KindSubscriptions:               {scope: "channel:read:subscriptions", ids: []string{"channel ID"}},
+	KindModeratorActions:            {scope: "channel:moderate", ids: []string{"user ID", "channel ID"}},
+	KindWhispers:                    {scope: "whispers:read", ids: []string{"user ID"}},
+	KindAutoModQueue:                {scope: "channel:moderate", ids: []string{"moderator ID", "channel ID"}},
+	KindUserModerationNotifications: {scope: "chat:read", ids: []string{"user ID", "channel ID"}},
+}
+
+// Scope returns the OAuth scope the token needs to listen to this kind of topic
+func (k TopicKind) Scope() string {
+	return topicKinds[k].scope
+}
+
+// TopicName is a parsed or built topic name
+type TopicName struct {
+	Kind TopicKind
+	IDs  []string
+}
+
+// String returns the topic name as sent to Twitch
+func (t TopicName) String() string {
+	return strings.Join(append([]string{string(t.Kind)}, t.IDs...), ".")
+}
+
+// Scope returns the OAuth scope the token needs to listen to the topic
+func (t TopicName) Scope() string {
+	return t.Kind.Scope()
+}
+
+// NewTopicName validates the IDs for the kind and builds a topic name
+func NewTopicName(kind TopicKind, ids ...string) (TopicName, error) {
+	info, ok := topicKinds[kind]
+	if !ok {
+		return TopicName{}, fmt.Errorf("unknown topic kind %q: %w", kind, ErrMalformedTopic)
+	}
+	if len(ids) != len(info.ids) {
+		return TopicName{}, fmt.Errorf("%s takes %d IDs, got %d: %w", kind, len(info.ids), len(ids), ErrMalformedTopic)
+	}
+
+	for i, id := range ids {
+		if !isTwitchID(id) {
+			return TopicName{}, fmt.Errorf("%s %s %q: %w", kind, info.ids[i], id, ErrMalformedTopic)
+		}
+	}
+
+	return TopicName{Kind: kind, IDs: ids}, nil
+}
+
+// ParseTopic splits a topic name back into its kind and IDs
+func ParseTopic(topic string) (TopicName, error) {
+	parts := strings.Split(topic, ".")
+	return NewTopicName(TopicKind(parts[0]), parts[1:]...)
+}
+
+// isTwitchID reports whether the ID is a numeric Twitch user or channel ID
+func isTwitchID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func buildTopic(kind TopicKind, ids ...string) (string, error) {
+	t, err := NewTopicName(kind, ids...)
+	if err != nil {
+		return "", err
+	}
+	return t.String(), nil
+}
+
+// BitsTopic is channel-bits-events-v1.<channel ID>, requires bits:read
+func BitsTopic(channelID string) (string, error) {
+	return buildTopic(KindBits, channelID)
+}
+
+// BitsV2Topic is channel-bits-events-v2.<channel ID>, requires bits:read
+func BitsV2Topic(channelID string) (string, error) {
+	return buildTopic(KindBitsV2, channelID)
+}
+
+// BitsBadgeUnlocksTopic is channel-bits-badge-unlocks.<channel ID>, requires bits:read
+func BitsBadgeUnlocksTopic(channelID string) (string, error) {
+	return buildTopic(KindBitsBadgeUnlocks, channelID)
+}
+
+// ChannelPointsTopic is channel-points-channel-v1.<channel ID>, requires channel:read:redemptions
+func ChannelPointsTopic(channelID string) (string, error) {
+	return buildTopic(KindChannelPoints, channelID)
+}
+
+// SubscriptionsTopic is channel-subscribe-events-v1.<channel ID>, requires channel:read:subscriptions
+func SubscriptionsTopic(channelID string) (string, error) {
+	return buildTopic(KindSubscriptions, channelID)
+}
+
+// ModeratorActionsTopic is chat_moderator_actions.<user ID>.<channel ID>, requires channel:moderate
+func ModeratorActionsTopic(userID, channelID string) (string, error) {
+	return buildTopic(KindModeratorActions, userID, channelID)
+}
+
+// WhispersTopic is whispers.<user ID>, requires whispers:read
+func WhispersTopic(userID string) (string, error) {
+	return buildTopic(KindWhispers, userID)
+}
+
+// AutoModQueueTopic is automod-queue.<moderator ID>.<channel ID>, requires channel:moderate
+func AutoModQueueTopic(moderatorID, channelID string) (string, error) {
+	return buildTopic(KindAutoModQueue, moderatorID, channelID)
+}
+
+// UserModerationNotificationsTopic is user-moderation-notifications.<user ID>.<channel ID>, requires chat:read
+func UserModerationNotificationsTopic(userID, channelID string) (string, error) {
+	return buildTopic(KindUserModerationNotifications, userID, channelID)
+}
@@ -0,0 +1,137 @@
+package pubsub
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestTopicBuildersRoundTrip(t *testing.T) {
+	tests := []struct {
+		build func() (string, error)
+		want  string
+		kind  TopicKind
+		ids   []string
+		scope string
+	}{
+		{
+			build: func() (string, error) { return BitsTopic("44322889") },
+			want:  "channel-bits-events-v1.44322889", kind: KindBits, ids: []string{"44322889"}, scope: "bits:read",
+		},
+		{
+			build: func() (string, error) { return BitsV2Topic("44322889") },
+			want:  "channel-bits-events-v2.44322889", kind: KindBitsV2, ids: []string{"44322889"}, scope: "bits:read",
+		},
+		{
+			build: func() (string, error) { return BitsBadgeUnlocksTopic("44322889") },
+			want:  "channel-bits-badge-unlocks.44322889", kind: KindBitsBadgeUnlocks, ids: []string{"44322889"}, scope: "bits:read",
+		},
+		{
+			build: func() (string, error) { return ChannelPointsTopic("44322889") },
+			want:  "channel-points-channel-v1.44322889", kind: KindChannelPoints, ids: []string{"44322889"}, scope: "channel:read:redemptions",
+		},
+		{
+			build: func() (string, error) { return SubscriptionsTopic("44322889") },
+			want:  "channel-subscribe-events-v1.44322889", kind: KindSubscriptions, ids: []string{"44322889"}, scope: "channel:read:subscriptions",
+		},
+		{
+			build: func() (string, error) { return ModeratorActionsTopic("12345", "44322889") },
+			want:  "chat_moderator_actions.12345.44322889", kind: KindModeratorActions, ids: []string{"12345", "44322889"}, scope: "channel:moderate",
+		},
+		{
+			build: func() (string, error) { return WhispersTopic("12345") },
+			want:  "whispers.12345", kind: KindWhispers, ids: []string{"12345"}, scope: "whispers:read",
+		},
+		{
+			build: func() (string, error) { return AutoModQueueTopic("12345", "44322889") },
+			want:  "automod-queue.12345.44322889", kind: KindAutoModQueue, ids: []string{"12345", "44322889"}, scope: "channel:moderate",
+		},
+		{
+			build: func() (string, error) { return UserModerationNotificationsTopic("12345", "44322889") },
+			want:  "user-moderation-notifications.12345.44322889", kind: KindUserModerationNotifications, ids: []string{"12345", "44322889"}, scope: "chat:read",
+		},
+	}
+
+	if len(tests) != len(topicKinds) {
+		t.Errorf("%d builders tested, %d topic kinds", len(tests), len(topicKinds))
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.kind), func(t *testing.T) {
+			topic, err := test.build()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if topic != test.want {
+				t.Errorf("built %q, want %q", topic, test.want)
+			}
+
+			parsed, err := ParseTopic(topic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Kind != test.kind || !equalStrings(parsed.IDs, test.ids) {
+				t.Errorf("parsed %s %v, want %s %v", parsed.Kind, parsed.IDs, test.kind, test.ids)
+			}
+			if parsed.String() != topic {
+				t.Errorf("parsed back to %q, want %q", parsed.String(), topic)
+			}
+			if parsed.Scope() != test.scope {
+				t.Errorf("scope = %q, want %q", parsed.Scope(), test.scope)
+			}
+		})
+	}
+}
+
+func TestTopicMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		build func() (string, error)
+	}{
+		{name: "parse missing ID", build: parse("whispers")},
+		{name: "parse extra ID", build: parse("whispers.12345.67890")},
+		{name: "parse missing second ID", build: parse("chat_moderator_actions.12345")},
+		{name: "parse empty ID", build: parse("channel-bits-events-v1.")},
+		{name: "parse non-numeric ID", build: parse("channel-points-channel-v1.abc")},
+		{name: "parse non-numeric second ID", build: parse("automod-queue.12345.67x90")},
+		{name: "parse negative ID", build: parse("whispers.-12345")},
+		{name: "parse unknown kind", build: parse("video-playback.12345")},
+		{name: "parse empty", build: parse("")},
+		{name: "build empty ID", build: func() (string, error) { return BitsTopic("") }},
+		{name: "build non-numeric ID", build: func() (string, error) { return WhispersTopic("user") }},
+		{name: "build non-numeric second ID", build: func() (string, error) { return ModeratorActionsTopic("12345", "channel") }},
+		{name: "build unknown kind", build: func() (string, error) { return buildTopic("hype-train-events-v1", "12345") }},
+		{name: "build wrong number of IDs", build: func() (string, error) { return buildTopic(KindWhispers, "12345", "67890") }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topic, err := test.build()
+			if !errors.Is(err, ErrMalformedTopic) || topic != "" {
+				t.Errorf("got %q, %v, want %v", topic, err, ErrMalformedTopic)
+			}
+		})
+	}
+}
+
+// parse adapts ParseTopic to the builders' signature
+func parse(topic string) func() (string, error) {
+	return func() (string, error) {
+		parsed, err := ParseTopic(topic)
+		if err != nil {
+			return "", err
+		}
+		return parsed.String(), nil
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}